@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+const (
+	accessListBlock = "block"
+	accessListAllow = "allow"
+
+	accessTypePubkey  = "pubkey"
+	accessTypeIP      = "ip"
+	accessTypeContent = "content"
+
+	// accessListRefreshInterval is how often entries are reloaded, picking
+	// up changes made through other relay instances and dropping expired
+	// ones.
+	accessListRefreshInterval = time.Minute
+
+	reasonPubkeyBlocked  = "blocked: pubkey is blocked"
+	reasonContentBlocked = "blocked: content is blocked"
+	reasonIPBlocked      = "blocked: ip is blocked"
+)
+
+// accessEntry blocks or allows a pubkey, an IP range or a content hash.
+type accessEntry struct {
+	ID        int64      `db:"id"`
+	List      string     `db:"list"`
+	Type      string     `db:"type"`
+	Value     string     `db:"value"`
+	Reason    string     `db:"reason"`
+	ExpiresAt *time.Time `db:"expires_at"`
+	CreatedAt time.Time  `db:"created_at"`
+}
+
+// Expired reports whether the entry no longer applies at now.
+func (e accessEntry) Expired(now time.Time) bool {
+	return e.ExpiresAt != nil && !now.Before(*e.ExpiresAt)
+}
+
+// accessList holds the block and allow lists, persisted in Postgres.
+//
+// Allow entries take precedence over block entries: an allowed IP gets
+// through a blocked range, an allowed content hash through a block, and an
+// allowed pubkey is exempt from both pubkey and content blocks.
+type accessList struct {
+	db  *sqlx.DB
+	now func() time.Time
+
+	mu sync.RWMutex
+	// values are the pubkey and content entries by list, type and value.
+	values map[string]map[string]map[string]accessEntry
+	// ranges are the IP entries by list.
+	ranges map[string][]accessRange
+}
+
+type accessRange struct {
+	prefix netip.Prefix
+	entry  accessEntry
+}
+
+func newAccessList(db *sqlx.DB) (*accessList, error) {
+	_, err := db.Exec(`
+CREATE TABLE IF NOT EXISTS access_list (
+  id bigserial PRIMARY KEY,
+  list text NOT NULL,
+  type text NOT NULL,
+  value text NOT NULL,
+  reason text NOT NULL DEFAULT '',
+  expires_at timestamptz,
+  created_at timestamptz NOT NULL DEFAULT NOW(),
+  UNIQUE (list, type, value)
+);
+`)
+	if err != nil {
+		return nil, fmt.Errorf("create table: %w", err)
+	}
+
+	a := &accessList{db: db, now: time.Now}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// load replaces the in-memory lists with the unexpired entries in the
+// database.
+func (a *accessList) load() error {
+	var entries []accessEntry
+	err := a.db.Select(&entries, `SELECT id, list, type, value, reason, expires_at, created_at
+FROM access_list
+WHERE expires_at IS NULL OR expires_at > NOW()`)
+	if err != nil {
+		return fmt.Errorf("select access list: %w", err)
+	}
+
+	a.set(entries)
+	return nil
+}
+
+// set replaces the in-memory lists with entries.
+func (a *accessList) set(entries []accessEntry) {
+	values := make(map[string]map[string]map[string]accessEntry)
+	ranges := make(map[string][]accessRange)
+	for _, e := range entries {
+		if e.Type == accessTypeIP {
+			prefix, err := netip.ParsePrefix(e.Value)
+			if err != nil {
+				log.Printf("access list entry %d: %v\n", e.ID, err)
+				continue
+			}
+			ranges[e.List] = append(ranges[e.List], accessRange{prefix: prefix, entry: e})
+			continue
+		}
+
+		if values[e.List] == nil {
+			values[e.List] = make(map[string]map[string]accessEntry)
+		}
+		if values[e.List][e.Type] == nil {
+			values[e.List][e.Type] = make(map[string]accessEntry)
+		}
+		values[e.List][e.Type][e.Value] = e
+	}
+
+	a.mu.Lock()
+	a.values = values
+	a.ranges = ranges
+	a.mu.Unlock()
+}
+
+func (a *accessList) refresh() {
+	for range time.Tick(accessListRefreshInterval) {
+		if err := a.load(); err != nil {
+			log.Printf("[error] refresh access list: %v\n", err)
+		}
+	}
+}
+
+// lookup returns the unexpired entry for value on list, if any.
+func (a *accessList) lookup(list, typ, value string) (accessEntry, bool) {
+	a.mu.RLock()
+	e, ok := a.values[list][typ][value]
+	a.mu.RUnlock()
+
+	return e, ok && !e.Expired(a.now())
+}
+
+// checkEvent returns false and a NIP-20 reason if evt's author or content
+// is blocked. It is safe to call on a nil *accessList.
+func (a *accessList) checkEvent(evt *nostr.Event) (bool, string) {
+	if a == nil {
+		return true, ""
+	}
+
+	if _, ok := a.lookup(accessListAllow, accessTypePubkey, evt.PubKey); ok {
+		return true, ""
+	}
+	if _, ok := a.lookup(accessListBlock, accessTypePubkey, evt.PubKey); ok {
+		return false, reasonPubkeyBlocked
+	}
+
+	for _, hash := range contentHashes(evt) {
+		if _, ok := a.lookup(accessListAllow, accessTypeContent, hash); ok {
+			continue
+		}
+		if _, ok := a.lookup(accessListBlock, accessTypeContent, hash); ok {
+			return false, reasonContentBlocked
+		}
+	}
+
+	return true, ""
+}
+
+// checkDeletion returns false and a NIP-20 reason if a deletion request
+// from pubkey over the connection in ctx is blocked. Deletions skip the
+// policies, so this is checked when they are applied. It is safe to call on
+// a nil *accessList.
+func (a *accessList) checkDeletion(ctx context.Context, pubkey string) (bool, string) {
+	if a == nil {
+		return true, ""
+	}
+
+	if ip, ok := connectionIP(ctx); ok {
+		if allowed, _ := a.allowIP(ip); !allowed {
+			return false, reasonIPBlocked
+		}
+	}
+	if _, ok := a.lookup(accessListAllow, accessTypePubkey, pubkey); ok {
+		return true, ""
+	}
+	if _, ok := a.lookup(accessListBlock, accessTypePubkey, pubkey); ok {
+		return false, reasonPubkeyBlocked
+	}
+
+	return true, ""
+}
+
+// allowIP reports whether ip may connect, returning the blocking entry if
+// not. Unparseable IPs are allowed. It is safe to call on a nil
+// *accessList.
+func (a *accessList) allowIP(ip string) (bool, accessEntry) {
+	if a == nil {
+		return true, accessEntry{}
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return true, accessEntry{}
+	}
+	addr = addr.Unmap()
+	now := a.now()
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for _, r := range a.ranges[accessListAllow] {
+		if !r.entry.Expired(now) && r.prefix.Contains(addr) {
+			return true, accessEntry{}
+		}
+	}
+	for _, r := range a.ranges[accessListBlock] {
+		if !r.entry.Expired(now) && r.prefix.Contains(addr) {
+			return false, r.entry
+		}
+	}
+
+	return true, accessEntry{}
+}
+
+// contentHashes returns the hashes an event's content can be blocked by:
+// the sha256 of its content and the file hashes in its x tags.
+func contentHashes(evt *nostr.Event) []string {
+	sum := sha256.Sum256([]byte(evt.Content))
+	hashes := []string{hex.EncodeToString(sum[:])}
+	for _, tag := range evt.Tags.GetAll([]string{"x"}) {
+		if x := strings.ToLower(tag.Value()); x != "" {
+			hashes = append(hashes, x)
+		}
+	}
+
+	return hashes
+}
+
+// normalizeAccessEntry validates e and puts its value in the form lookups
+// use: hex pubkeys, IP prefixes and lowercase hashes.
+func normalizeAccessEntry(e accessEntry) (accessEntry, error) {
+	if e.List != accessListBlock && e.List != accessListAllow {
+		return e, fmt.Errorf("unknown list %q", e.List)
+	}
+
+	value := strings.TrimSpace(e.Value)
+	switch e.Type {
+	case accessTypePubkey:
+		if strings.HasPrefix(value, "npub") {
+			prefix, decoded, err := nip19.Decode(value)
+			if err != nil || prefix != "npub" {
+				return e, fmt.Errorf("invalid npub %q", value)
+			}
+			value = decoded.(string)
+		}
+		value = strings.ToLower(value)
+		if !isSHA256Hex(value) {
+			return e, fmt.Errorf("invalid pubkey %q", value)
+		}
+	case accessTypeIP:
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return e, fmt.Errorf("invalid ip %q", value)
+			}
+			value = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()).String()
+			break
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return e, fmt.Errorf("invalid ip range %q", value)
+		}
+		value = prefix.Masked().String()
+	case accessTypeContent:
+		value = strings.ToLower(value)
+		if !isSHA256Hex(value) {
+			return e, fmt.Errorf("invalid content hash %q", value)
+		}
+	default:
+		return e, fmt.Errorf("unknown type %q", e.Type)
+	}
+
+	e.Value = value
+	return e, nil
+}
+
+// add saves e, replacing any entry for the same value on the same list.
+func (a *accessList) add(e accessEntry) (accessEntry, error) {
+	e, err := normalizeAccessEntry(e)
+	if err != nil {
+		return e, err
+	}
+
+	err = a.db.Get(&e, `INSERT INTO access_list (list, type, value, reason, expires_at)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (list, type, value) DO UPDATE SET reason = EXCLUDED.reason, expires_at = EXCLUDED.expires_at, created_at = NOW()
+RETURNING id, list, type, value, reason, expires_at, created_at`, e.List, e.Type, e.Value, e.Reason, e.ExpiresAt)
+	if err != nil {
+		return e, fmt.Errorf("insert access list: %w", err)
+	}
+
+	return e, a.load()
+}
+
+// remove deletes the entry with id.
+func (a *accessList) remove(id int64) error {
+	res, err := a.db.Exec("DELETE FROM access_list WHERE id = $1", id)
+	if err != nil {
+		return fmt.Errorf("delete access list: %w", err)
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("access list entry %d not found", id)
+	}
+
+	return a.load()
+}
+
+// list returns the latest entries, optionally only those on list, expired
+// ones included.
+func (a *accessList) list(list string, limit int) ([]accessEntry, error) {
+	var entries []accessEntry
+	err := a.db.Select(&entries, `SELECT id, list, type, value, reason, expires_at, created_at
+FROM access_list
+WHERE $1 = '' OR list = $1
+ORDER BY id DESC
+LIMIT $2`, list, limit)
+	if err != nil {
+		return nil, fmt.Errorf("select access list: %w", err)
+	}
+
+	return entries, nil
+}
+
+// accessListPolicy rejects events from blocked pubkeys or IPs, or with
+// blocked content. The IP is checked on every event, so a block also
+// applies to connections opened before it was added.
+type accessListPolicy struct {
+	storage *storage
+}
+
+func (p accessListPolicy) Name() string { return "access_list" }
+
+func (p accessListPolicy) Evaluate(ctx context.Context, evt *nostr.Event) (bool, string) {
+	if ip, ok := connectionIP(ctx); ok {
+		if allowed, _ := p.storage.access.allowIP(ip); !allowed {
+			return false, reasonIPBlocked
+		}
+	}
+
+	return p.storage.access.checkEvent(evt)
+}
+
+// deleteEventsByPubkey soft-deletes all of pubkey's events, returning how
+// many there were.
+func (s *storage) deleteEventsByPubkey(ctx context.Context, pubkey, changedBy string) (int, error) {
+	if pubkey == "" {
+		return 0, errors.New("must provide pubkey")
+	}
+
+	var ids []string
+	if err := s.DB.SelectContext(ctx, &ids, "SELECT id FROM event WHERE pubkey = $1", pubkey); err != nil {
+		return 0, fmt.Errorf("select events: %w", err)
+	}
+	if err := s.moderation.setState(ctx, ids, moderationDeleted, changedBy); err != nil {
+		return 0, err
+	}
+
+	return len(ids), nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessListCheckEvent(t *testing.T) {
+	const (
+		blockedPubkey = "e6230af84359c4bedd38207a349dfbf8d25ad3b767518e7231fcae03907b9282"
+		allowedPubkey = "82f3b82c7f855340fc1905b20ac50b95d64c700d2b9546507415088e81535425"
+		expiredPubkey = "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"
+		otherPubkey   = "fa984bd7dbb282f07e16e7ae87b26a2a7b9b90b7246a44771f0cf5ae58018f52"
+		blockedHash   = "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+		allowedHash   = "fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9"
+	)
+
+	now := time.Unix(1690000000, 0)
+	past := now.Add(-time.Minute)
+	content := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+
+	a := &accessList{now: func() time.Time { return now }}
+	a.set([]accessEntry{
+		{List: accessListBlock, Type: accessTypePubkey, Value: blockedPubkey},
+		{List: accessListBlock, Type: accessTypePubkey, Value: allowedPubkey},
+		{List: accessListAllow, Type: accessTypePubkey, Value: allowedPubkey},
+		{List: accessListBlock, Type: accessTypePubkey, Value: expiredPubkey, ExpiresAt: &past},
+		{List: accessListBlock, Type: accessTypeContent, Value: content("spam")},
+		{List: accessListBlock, Type: accessTypeContent, Value: blockedHash},
+		{List: accessListBlock, Type: accessTypeContent, Value: allowedHash},
+		{List: accessListAllow, Type: accessTypeContent, Value: allowedHash},
+	})
+
+	var tests = []struct {
+		name           string
+		event          *nostr.Event
+		expected       bool
+		expectedReason string
+	}{
+		{
+			name:     "not listed",
+			event:    &nostr.Event{PubKey: otherPubkey, Content: "hello"},
+			expected: true,
+		},
+		{
+			name:           "blocked pubkey",
+			event:          &nostr.Event{PubKey: blockedPubkey, Content: "hello"},
+			expected:       false,
+			expectedReason: reasonPubkeyBlocked,
+		},
+		{
+			name:     "allowed pubkey",
+			event:    &nostr.Event{PubKey: allowedPubkey, Content: "spam"},
+			expected: true,
+		},
+		{
+			name:     "expired block",
+			event:    &nostr.Event{PubKey: expiredPubkey, Content: "hello"},
+			expected: true,
+		},
+		{
+			name:           "blocked content",
+			event:          &nostr.Event{PubKey: otherPubkey, Content: "spam"},
+			expected:       false,
+			expectedReason: reasonContentBlocked,
+		},
+		{
+			name:           "blocked file hash",
+			event:          &nostr.Event{PubKey: otherPubkey, Kind: 1063, Tags: nostr.Tags{{"x", "2C26B46B68FFC68FF99B453C1D30413413422D706483BFA0F98A5E886266E7AE"}}},
+			expected:       false,
+			expectedReason: reasonContentBlocked,
+		},
+		{
+			name:     "allowed file hash",
+			event:    &nostr.Event{PubKey: otherPubkey, Kind: 1063, Tags: nostr.Tags{{"x", allowedHash}}},
+			expected: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, reason := a.checkEvent(tt.event)
+			assert.Equal(t, tt.expected, ok)
+			assert.Equal(t, tt.expectedReason, reason)
+		})
+	}
+}
+
+func TestAccessListAllowIP(t *testing.T) {
+	now := time.Unix(1690000000, 0)
+	past := now.Add(-time.Minute)
+
+	a := &accessList{now: func() time.Time { return now }}
+	a.set([]accessEntry{
+		{ID: 1, List: accessListBlock, Type: accessTypeIP, Value: "203.0.113.0/24"},
+		{ID: 2, List: accessListAllow, Type: accessTypeIP, Value: "203.0.113.7/32"},
+		{ID: 3, List: accessListBlock, Type: accessTypeIP, Value: "2001:db8::/32"},
+		{ID: 4, List: accessListBlock, Type: accessTypeIP, Value: "198.51.100.1/32", ExpiresAt: &past},
+	})
+
+	var tests = []struct {
+		ip            string
+		expected      bool
+		expectedEntry int64
+	}{
+		{ip: "192.0.2.1", expected: true},
+		{ip: "203.0.113.8", expected: false, expectedEntry: 1},
+		{ip: "::ffff:203.0.113.8", expected: false, expectedEntry: 1},
+		{ip: "203.0.113.7", expected: true},
+		{ip: "2001:db8::1", expected: false, expectedEntry: 3},
+		{ip: "198.51.100.1", expected: true},
+		{ip: "not an ip", expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			ok, entry := a.allowIP(tt.ip)
+			assert.Equal(t, tt.expected, ok)
+			assert.Equal(t, tt.expectedEntry, entry.ID)
+		})
+	}
+}
+
+func TestAccessListNil(t *testing.T) {
+	var a *accessList
+
+	ok, _ := a.checkEvent(&nostr.Event{})
+	assert.True(t, ok)
+
+	ok, _ = a.allowIP("203.0.113.7")
+	assert.True(t, ok)
+}
+
+func TestNormalizeAccessEntry(t *testing.T) {
+	const pubkey = "e6230af84359c4bedd38207a349dfbf8d25ad3b767518e7231fcae03907b9282"
+
+	var tests = []struct {
+		name          string
+		entry         accessEntry
+		expectedValue string
+		expectedErr   bool
+	}{
+		{
+			name:          "hex pubkey",
+			entry:         accessEntry{List: accessListBlock, Type: accessTypePubkey, Value: " E6230AF84359C4BEDD38207A349DFBF8D25AD3B767518E7231FCAE03907B9282 "},
+			expectedValue: pubkey,
+		},
+		{
+			name:          "npub",
+			entry:         accessEntry{List: accessListBlock, Type: accessTypePubkey, Value: stemstrNpub},
+			expectedValue: stemstrHexpub,
+		},
+		{
+			name:        "invalid pubkey",
+			entry:       accessEntry{List: accessListBlock, Type: accessTypePubkey, Value: "nope"},
+			expectedErr: true,
+		},
+		{
+			name:          "single ip",
+			entry:         accessEntry{List: accessListBlock, Type: accessTypeIP, Value: "203.0.113.7"},
+			expectedValue: "203.0.113.7/32",
+		},
+		{
+			name:          "ip range",
+			entry:         accessEntry{List: accessListBlock, Type: accessTypeIP, Value: "203.0.113.7/24"},
+			expectedValue: "203.0.113.0/24",
+		},
+		{
+			name:        "invalid ip",
+			entry:       accessEntry{List: accessListBlock, Type: accessTypeIP, Value: "203.0.113"},
+			expectedErr: true,
+		},
+		{
+			name:          "content hash",
+			entry:         accessEntry{List: accessListAllow, Type: accessTypeContent, Value: "2C26B46B68FFC68FF99B453C1D30413413422D706483BFA0F98A5E886266E7AE"},
+			expectedValue: "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+		},
+		{
+			name:        "unknown type",
+			entry:       accessEntry{List: accessListBlock, Type: "email", Value: "a@b.c"},
+			expectedErr: true,
+		},
+		{
+			name:        "unknown list",
+			entry:       accessEntry{List: "maybe", Type: accessTypePubkey, Value: pubkey},
+			expectedErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := normalizeAccessEntry(tt.entry)
+			if tt.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedValue, e.Value)
+		})
+	}
+}
+
+func TestAccessListPolicy(t *testing.T) {
+	a := &accessList{now: time.Now}
+	a.set([]accessEntry{
+		{List: accessListBlock, Type: accessTypePubkey, Value: "blocked"},
+		{List: accessListBlock, Type: accessTypeIP, Value: "203.0.113.0/24"},
+	})
+	p := accessListPolicy{storage: &storage{access: a}}
+
+	ok, reason := p.Evaluate(context.Background(), &nostr.Event{PubKey: "blocked"})
+	assert.False(t, ok)
+	assert.Equal(t, reasonPubkeyBlocked, reason)
+
+	ok, _ = p.Evaluate(context.Background(), &nostr.Event{PubKey: "other"})
+	assert.True(t, ok)
+
+	// Blocking an IP applies to connections that are already open
+	ok, reason = p.Evaluate(ipContext("203.0.113.7"), &nostr.Event{PubKey: "other"})
+	assert.False(t, ok)
+	assert.Equal(t, reasonIPBlocked, reason)
+
+	ok, _ = p.Evaluate(ipContext("198.51.100.1"), &nostr.Event{PubKey: "other"})
+	assert.True(t, ok)
+}
+
+func TestQueryEventsBlockedIP(t *testing.T) {
+	a := &accessList{now: time.Now}
+	a.set([]accessEntry{{List: accessListBlock, Type: accessTypeIP, Value: "203.0.113.0/24"}})
+	s := &storage{access: a}
+
+	_, err := s.QueryEvents(ipContext("203.0.113.7"), &nostr.Filter{})
+	assert.EqualError(t, err, reasonIPBlocked)
+}
+
+func TestDeleteEventBlocked(t *testing.T) {
+	a := &accessList{now: time.Now}
+	a.set([]accessEntry{
+		{List: accessListBlock, Type: accessTypePubkey, Value: "blocked"},
+		{List: accessListBlock, Type: accessTypeIP, Value: "203.0.113.0/24"},
+	})
+	s := &storage{access: a}
+
+	var tests = []struct {
+		name     string
+		ctx      context.Context
+		pubkey   string
+		expected string
+	}{
+		{
+			name:     "blocked pubkey",
+			ctx:      context.Background(),
+			pubkey:   "blocked",
+			expected: reasonPubkeyBlocked,
+		},
+		{
+			name:     "blocked ip",
+			ctx:      ipContext("203.0.113.7"),
+			pubkey:   "other",
+			expected: reasonIPBlocked,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.EqualError(t, s.DeleteEvent(tt.ctx, "id", tt.pubkey), tt.expected)
+		})
+	}
+}
+
+func TestAllowLiveEventBlockedIP(t *testing.T) {
+	a := &accessList{now: time.Now}
+	a.set([]accessEntry{{List: accessListBlock, Type: accessTypeIP, Value: "203.0.113.0/24"}})
+	r := Relay{storage: &storage{access: a}}
+
+	assert.False(t, r.AllowLiveEvent(ipContext("203.0.113.7"), &nostr.Event{Kind: 1}))
+	assert.True(t, r.AllowLiveEvent(ipContext("198.51.100.1"), &nostr.Event{Kind: 1}))
+}
+
+func TestConnectionLimiterBlockedIP(t *testing.T) {
+	a := &accessList{now: time.Now}
+	a.set([]accessEntry{{List: accessListBlock, Type: accessTypeIP, Value: "203.0.113.0/24"}})
+	handler := connectionLimiter{
+		next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+		limits: newRateLimiters(RateLimitConfig{}),
+		access: a,
+	}
+
+	connect := func(remoteAddr string) int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("Upgrade", "websocket")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, connect("203.0.113.7:1234"))
+	assert.Equal(t, http.StatusOK, connect("192.0.2.1:1234"))
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	adminSessionCookie = "relay_admin_session"
+	adminCSRFHeader    = "X-CSRF-Token"
+
+	defaultAdminSessionTTL    = 12 * time.Hour
+	defaultAdminMaxFailures   = 5
+	defaultAdminFailureWindow = 15 * time.Minute
+	defaultAdminLockout       = 15 * time.Minute
+
+	// minSessionSecretLength is the shortest session secret accepted, in
+	// bytes.
+	minSessionSecretLength = 32
+	// hashPasswordCost is the bcrypt cost of hashes made by -hash-password.
+	hashPasswordCost = 12
+)
+
+// dummyPasswordHash is checked against when the username is unknown, so
+// unknown and known usernames take as long to reject. It is a hash of
+// "dummy password" made with hashPasswordCost, like -hash-password makes.
+var dummyPasswordHash = []byte("$2a$12$0R4a9PwENMKAjBceMd5O0.da2RmKvbhWJXs.UkR8.iDzKyz8hxhue")
+
+type adminSessionKey struct{}
+
+// adminSession is the signed in admin a request was made by.
+type adminSession struct {
+	user string
+	csrf string
+}
+
+// sessionPayload is the signed content of a session cookie.
+type sessionPayload struct {
+	User      string `json:"u"`
+	ExpiresAt int64  `json:"e"`
+	Nonce     string `json:"n"`
+}
+
+// adminAuth signs admins in with hashed passwords and keeps them signed in
+// with signed session cookies.
+type adminAuth struct {
+	// admins maps usernames to bcrypt or argon2id password hashes.
+	admins            map[string]string
+	secret            []byte
+	ttl               time.Duration
+	lockouts          *loginLockout
+	trustForwardedFor bool
+	now               func() time.Time
+}
+
+func newAdminAuth(cfg Config) (*adminAuth, error) {
+	for user, hash := range cfg.Admins {
+		if err := validPasswordHash(hash); err != nil {
+			return nil, fmt.Errorf("admin %q: %w, generate one with -hash-password", user, err)
+		}
+	}
+
+	secret := []byte(cfg.AdminAuth.SessionSecret)
+	if len(secret) == 0 {
+		log.Printf("admin_auth.session_secret not set, admin sessions won't survive restarts or work across instances\n")
+		secret = make([]byte, minSessionSecretLength)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("generate session secret: %w", err)
+		}
+	} else if len(secret) < minSessionSecretLength {
+		return nil, fmt.Errorf("admin_auth.session_secret must be at least %d bytes", minSessionSecretLength)
+	}
+
+	a := &adminAuth{
+		admins:            cfg.Admins,
+		secret:            secret,
+		ttl:               cfg.AdminAuth.SessionTTL,
+		lockouts:          newLoginLockout(cfg.AdminAuth),
+		trustForwardedFor: cfg.RateLimits.TrustForwardedFor,
+		now:               time.Now,
+	}
+	if a.ttl <= 0 {
+		a.ttl = defaultAdminSessionTTL
+	}
+
+	return a, nil
+}
+
+// validPasswordHash returns an error unless hash is a bcrypt or argon2id
+// hash verifyPassword can check.
+func validPasswordHash(hash string) error {
+	switch {
+	case isBcryptHash(hash):
+		_, err := bcrypt.Cost([]byte(hash))
+		return err
+	case strings.HasPrefix(hash, "$argon2id$"):
+		_, err := parseArgon2idHash(hash)
+		return err
+	}
+
+	return errors.New("password must be a bcrypt or argon2id hash")
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// verifyPassword checks password against a bcrypt or argon2id hash in
+// constant time.
+func verifyPassword(hash, password string) bool {
+	switch {
+	case isBcryptHash(hash):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		h, err := parseArgon2idHash(hash)
+		if err != nil {
+			return false
+		}
+		key := argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+		return subtle.ConstantTimeCompare(key, h.key) == 1
+	}
+
+	return false
+}
+
+type argon2idHash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// parseArgon2idHash reads a hash in the PHC string format, e.g.
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>.
+func parseArgon2idHash(hash string) (argon2idHash, error) {
+	var h argon2idHash
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return h, errors.New("malformed argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return h, errors.New("unsupported argon2id version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return h, errors.New("malformed argon2id parameters")
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return h, errors.New("malformed argon2id salt")
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return h, errors.New("malformed argon2id key")
+	}
+
+	return h, nil
+}
+
+// hashPassword returns the bcrypt hash of password for the admins config.
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), hashPasswordCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// login checks user's password, unless ip is locked out. Failed attempts
+// count towards a lockout of ip. Usernames aren't locked out, so anyone who
+// knows one can't lock its admin out.
+func (a *adminAuth) login(user, password, ip string) (ok, locked bool) {
+	keys := []string{"ip:" + ip}
+	if a.lockouts.locked(keys...) {
+		return false, true
+	}
+
+	hash, known := a.admins[user]
+	if !known {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+	}
+	if !known || !verifyPassword(hash, password) {
+		a.lockouts.fail(keys...)
+		return false, false
+	}
+
+	a.lockouts.reset(keys...)
+	return true, false
+}
+
+// newSession returns a signed session cookie value for user.
+func (a *adminAuth) newSession(user string) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(sessionPayload{
+		User:      user,
+		ExpiresAt: a.now().Add(a.ttl).Unix(),
+		Nonce:     hex.EncodeToString(nonce),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(a.sign(encoded, user)), nil
+}
+
+// sign MACs a session payload together with the admin's password hash, so
+// changing the password ends their sessions.
+func (a *adminAuth) sign(payload, user string) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(payload))
+	mac.Write([]byte{0})
+	mac.Write([]byte(a.admins[user]))
+	return mac.Sum(nil)
+}
+
+// csrfToken is the token mutating requests of the session must send.
+func (a *adminAuth) csrfToken(session string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte("csrf:"))
+	mac.Write([]byte(session))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// session returns the admin signed in by r's session cookie.
+func (a *adminAuth) session(r *http.Request) (adminSession, bool) {
+	cookie, err := r.Cookie(adminSessionCookie)
+	if err != nil {
+		return adminSession{}, false
+	}
+
+	encoded, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return adminSession{}, false
+	}
+	payloadb, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return adminSession{}, false
+	}
+	sigb, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return adminSession{}, false
+	}
+
+	var payload sessionPayload
+	if err := json.Unmarshal(payloadb, &payload); err != nil {
+		return adminSession{}, false
+	}
+	if _, ok := a.admins[payload.User]; !ok {
+		return adminSession{}, false
+	}
+	if !hmac.Equal(sigb, a.sign(encoded, payload.User)) {
+		return adminSession{}, false
+	}
+	if a.now().Unix() >= payload.ExpiresAt {
+		return adminSession{}, false
+	}
+
+	return adminSession{user: payload.User, csrf: a.csrfToken(cookie.Value)}, true
+}
+
+// protect only lets signed in admins through to next, adding the session
+// to the request context. Page loads without a session are sent to the
+// login form. Mutating requests must carry the session's CSRF token in the
+// X-CSRF-Token header.
+func (a *adminAuth) protect(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, ok := a.session(r)
+		if !ok {
+			if r.Method == http.MethodGet {
+				http.Redirect(w, r, "/admin/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+				return
+			}
+			writeUnauthorized(w)
+			return
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			token := r.Header.Get(adminCSRFHeader)
+			if subtle.ConstantTimeCompare([]byte(token), []byte(session.csrf)) != 1 {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte("invalid csrf token"))
+				return
+			}
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), adminSessionKey{}, session)))
+	}
+}
+
+// setSessionCookie signs user in on the client.
+func (a *adminAuth) setSessionCookie(w http.ResponseWriter, r *http.Request, value string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminSessionCookie,
+		Value:    value,
+		Path:     "/admin",
+		MaxAge:   int(a.ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminSessionCookie,
+		Path:     "/admin",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// sessionFromContext returns the admin session protect added to ctx.
+func sessionFromContext(ctx context.Context) (adminSession, bool) {
+	session, ok := ctx.Value(adminSessionKey{}).(adminSession)
+	return session, ok
+}
+
+// sameOrigin reports whether r was sent by a page of this host, going by
+// its Origin header or, if a browser didn't send one, its Referer. Requests
+// with neither are refused, as a login form is only used from a browser.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return false
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// safeRedirect returns next if it is a path on this server's admin UI, so
+// the login form can't be used to redirect elsewhere.
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/admin") || strings.HasPrefix(next, "/admin/login") {
+		return "/admin"
+	}
+
+	return next
+}
+
+// loginLockout locks out IPs after repeated failed logins.
+type loginLockout struct {
+	maxFailures int
+	window      time.Duration
+	lockout     time.Duration
+	now         func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*lockoutEntry
+}
+
+type lockoutEntry struct {
+	failures    int
+	firstFailed time.Time
+	lockedUntil time.Time
+}
+
+func newLoginLockout(cfg AdminAuthConfig) *loginLockout {
+	l := &loginLockout{
+		maxFailures: cfg.MaxFailures,
+		window:      cfg.FailureWindow,
+		lockout:     cfg.LockoutDuration,
+		now:         time.Now,
+		entries:     make(map[string]*lockoutEntry),
+	}
+	if l.maxFailures <= 0 {
+		l.maxFailures = defaultAdminMaxFailures
+	}
+	if l.window <= 0 {
+		l.window = defaultAdminFailureWindow
+	}
+	if l.lockout <= 0 {
+		l.lockout = defaultAdminLockout
+	}
+
+	return l
+}
+
+// locked reports whether any of keys is locked out.
+func (l *loginLockout) locked(keys ...string) bool {
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range keys {
+		if e, ok := l.entries[key]; ok && now.Before(e.lockedUntil) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fail counts a failed login against keys, locking out those with too many
+// failures within the window.
+func (l *loginLockout) fail(keys ...string) {
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range keys {
+		e, ok := l.entries[key]
+		if !ok || now.Sub(e.firstFailed) > l.window {
+			e = &lockoutEntry{firstFailed: now}
+			l.entries[key] = e
+		}
+
+		e.failures++
+		if e.failures >= l.maxFailures {
+			e.lockedUntil = now.Add(l.lockout)
+			e.failures = 0
+			e.firstFailed = now
+			log.Printf("locked out admin login for %s until %s\n", key, e.lockedUntil.Format(time.RFC3339))
+		}
+	}
+
+	// Drop stale entries so failed guesses can't grow the map forever
+	if len(l.entries) > 10000 {
+		for key, e := range l.entries {
+			if now.Sub(e.firstFailed) > l.window && !now.Before(e.lockedUntil) {
+				delete(l.entries, key)
+			}
+		}
+	}
+}
+
+// reset forgets the failures of keys after a successful login.
+func (l *loginLockout) reset(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range keys {
+		if e, ok := l.entries[key]; ok && !l.now().Before(e.lockedUntil) {
+			delete(l.entries, key)
+		}
+	}
+}
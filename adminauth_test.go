@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testSessionSecret = "0123456789abcdef0123456789abcdef"
+
+func testBcryptHash(t *testing.T, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	assert.NoError(t, err)
+	return string(hash)
+}
+
+func testArgon2idHash(password string) string {
+	salt := []byte("somesaltsomesalt")
+	key := argon2.IDKey([]byte(password), salt, 1, 8*1024, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, 8*1024, 1, 1,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func testAdminAuth(t *testing.T, now time.Time) *adminAuth {
+	a, err := newAdminAuth(Config{
+		Admins:    map[string]string{"alice": testBcryptHash(t, "secret")},
+		AdminAuth: AdminAuthConfig{SessionSecret: testSessionSecret},
+	})
+	assert.NoError(t, err)
+	a.now = func() time.Time { return now }
+	a.lockouts.now = a.now
+	return a
+}
+
+func TestVerifyPassword(t *testing.T) {
+	bcryptHash := testBcryptHash(t, "secret")
+	argon2idHash := testArgon2idHash("secret")
+
+	var tests = []struct {
+		name     string
+		hash     string
+		password string
+		expected bool
+	}{
+		{
+			name:     "bcrypt",
+			hash:     bcryptHash,
+			password: "secret",
+			expected: true,
+		},
+		{
+			name:     "bcrypt wrong password",
+			hash:     bcryptHash,
+			password: "Secret",
+		},
+		{
+			name:     "argon2id",
+			hash:     argon2idHash,
+			password: "secret",
+			expected: true,
+		},
+		{
+			name:     "argon2id wrong password",
+			hash:     argon2idHash,
+			password: "secret ",
+		},
+		{
+			name:     "plaintext",
+			hash:     "secret",
+			password: "secret",
+		},
+		{
+			name:     "malformed argon2id",
+			hash:     "$argon2id$v=19$m=8192$c2FsdA$a2V5",
+			password: "secret",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, verifyPassword(tt.hash, tt.password))
+		})
+	}
+}
+
+func TestDummyPasswordHash(t *testing.T) {
+	// Rejecting unknown usernames must take as long as checking a real hash
+	cost, err := bcrypt.Cost(dummyPasswordHash)
+	assert.NoError(t, err)
+	assert.Equal(t, hashPasswordCost, cost)
+	assert.NoError(t, bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte("dummy password")))
+}
+
+func TestNewAdminAuth(t *testing.T) {
+	hashes := map[string]string{"alice": testBcryptHash(t, "secret"), "bob": testArgon2idHash("secret")}
+
+	_, err := newAdminAuth(Config{Admins: hashes, AdminAuth: AdminAuthConfig{SessionSecret: testSessionSecret}})
+	assert.NoError(t, err)
+
+	a, err := newAdminAuth(Config{Admins: hashes})
+	assert.NoError(t, err)
+	assert.Len(t, a.secret, minSessionSecretLength)
+	assert.Equal(t, defaultAdminSessionTTL, a.ttl)
+
+	_, err = newAdminAuth(Config{Admins: map[string]string{"alice": "password"}})
+	assert.Error(t, err)
+
+	_, err = newAdminAuth(Config{Admins: hashes, AdminAuth: AdminAuthConfig{SessionSecret: "short"}})
+	assert.Error(t, err)
+}
+
+func TestAdminSession(t *testing.T) {
+	now := time.Unix(1690000000, 0)
+	a := testAdminAuth(t, now)
+
+	value, err := a.newSession("alice")
+	assert.NoError(t, err)
+
+	request := func(value string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/admin", nil)
+		r.AddCookie(&http.Cookie{Name: adminSessionCookie, Value: value})
+		return r
+	}
+
+	session, ok := a.session(request(value))
+	assert.True(t, ok)
+	assert.Equal(t, "alice", session.user)
+	assert.Equal(t, a.csrfToken(value), session.csrf)
+
+	other, err := a.newSession("alice")
+	assert.NoError(t, err)
+	assert.NotEqual(t, a.csrfToken(value), a.csrfToken(other))
+
+	_, ok = a.session(httptest.NewRequest(http.MethodGet, "/admin", nil))
+	assert.False(t, ok, "no cookie")
+
+	_, ok = a.session(request(value + "x"))
+	assert.False(t, ok, "tampered signature")
+
+	payload, sig, _ := strings.Cut(value, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"u":"alice","e":9999999999,"n":"00"}`))
+	_, ok = a.session(request(forged + "." + sig))
+	assert.False(t, ok, "tampered payload")
+	assert.NotEqual(t, payload, forged)
+
+	a.now = func() time.Time { return now.Add(defaultAdminSessionTTL) }
+	_, ok = a.session(request(value))
+	assert.False(t, ok, "expired")
+	a.now = func() time.Time { return now }
+
+	a.admins["alice"] = testBcryptHash(t, "new secret")
+	_, ok = a.session(request(value))
+	assert.False(t, ok, "password changed")
+
+	delete(a.admins, "alice")
+	_, ok = a.session(request(value))
+	assert.False(t, ok, "admin removed")
+}
+
+func TestAdminAuthProtect(t *testing.T) {
+	a := testAdminAuth(t, time.Now())
+	value, err := a.newSession("alice")
+	assert.NoError(t, err)
+
+	handler := a.protect(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(adminName(r)))
+	})
+
+	var tests = []struct {
+		name             string
+		method           string
+		cookie           bool
+		csrf             string
+		expectedStatus   int
+		expectedBody     string
+		expectedLocation string
+	}{
+		{
+			name:             "page without session",
+			method:           http.MethodGet,
+			expectedStatus:   http.StatusSeeOther,
+			expectedLocation: "/admin/login?next=%2Fadmin%3Fkind%3D1",
+		},
+		{
+			name:           "mutation without session",
+			method:         http.MethodPost,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "page",
+			method:         http.MethodGet,
+			cookie:         true,
+			expectedStatus: http.StatusOK,
+			expectedBody:   "alice",
+		},
+		{
+			name:           "mutation without csrf token",
+			method:         http.MethodPost,
+			cookie:         true,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "mutation with wrong csrf token",
+			method:         http.MethodDelete,
+			cookie:         true,
+			csrf:           a.csrfToken("other session"),
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "mutation",
+			method:         http.MethodPost,
+			cookie:         true,
+			csrf:           a.csrfToken(value),
+			expectedStatus: http.StatusOK,
+			expectedBody:   "alice",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/admin?kind=1", nil)
+			if tt.cookie {
+				r.AddCookie(&http.Cookie{Name: adminSessionCookie, Value: value})
+			}
+			if tt.csrf != "" {
+				r.Header.Set(adminCSRFHeader, tt.csrf)
+			}
+
+			w := httptest.NewRecorder()
+			handler(w, r)
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedBody != "" {
+				assert.Equal(t, tt.expectedBody, w.Body.String())
+			}
+			assert.Equal(t, tt.expectedLocation, w.Header().Get("Location"))
+		})
+	}
+}
+
+func TestAdminLogin(t *testing.T) {
+	now := time.Unix(1690000000, 0)
+	a := testAdminAuth(t, now)
+
+	ok, locked := a.login("alice", "secret", "198.51.100.1")
+	assert.True(t, ok)
+	assert.False(t, locked)
+
+	for i := 0; i < defaultAdminMaxFailures; i++ {
+		ok, locked = a.login("alice", "guess", "198.51.100.1")
+		assert.False(t, ok)
+		assert.False(t, locked)
+	}
+
+	// Failures from one IP don't lock the admin out elsewhere
+	ok, locked = a.login("alice", "secret", "203.0.113.7")
+	assert.True(t, ok)
+	assert.False(t, locked)
+
+	ok, locked = a.login("bob", "secret", "198.51.100.1")
+	assert.False(t, ok, "ip locked out")
+	assert.True(t, locked)
+
+	a.lockouts.now = func() time.Time { return now.Add(defaultAdminLockout) }
+	ok, locked = a.login("alice", "secret", "198.51.100.1")
+	assert.True(t, ok)
+	assert.False(t, locked)
+}
+
+func TestLoginLockout(t *testing.T) {
+	now := time.Unix(1690000000, 0)
+	l := newLoginLockout(AdminAuthConfig{MaxFailures: 3, FailureWindow: time.Minute, LockoutDuration: time.Hour})
+	l.now = func() time.Time { return now }
+
+	l.fail("ip:198.51.100.1")
+	l.fail("ip:198.51.100.1")
+	assert.False(t, l.locked("ip:198.51.100.1"))
+
+	// Failures outside the window start over
+	now = now.Add(2 * time.Minute)
+	l.fail("ip:198.51.100.1")
+	l.fail("ip:198.51.100.1")
+	assert.False(t, l.locked("ip:198.51.100.1"))
+
+	l.fail("ip:198.51.100.1")
+	assert.True(t, l.locked("ip:198.51.100.1"))
+	assert.True(t, l.locked("ip:203.0.113.7", "ip:198.51.100.1"))
+	assert.False(t, l.locked("ip:203.0.113.7"))
+
+	// A successful login can't end a lockout early
+	l.reset("ip:198.51.100.1")
+	assert.True(t, l.locked("ip:198.51.100.1"))
+
+	now = now.Add(time.Hour)
+	assert.False(t, l.locked("ip:198.51.100.1"))
+}
+
+func TestSameOrigin(t *testing.T) {
+	var tests = []struct {
+		name     string
+		origin   string
+		referer  string
+		expected bool
+	}{
+		{
+			name:     "same origin",
+			origin:   "https://relay.stemstr.app",
+			expected: true,
+		},
+		{
+			name:     "same origin referer",
+			referer:  "https://relay.stemstr.app/admin/login?next=/admin",
+			expected: true,
+		},
+		{
+			name:     "cross origin",
+			origin:   "https://evil.example",
+			referer:  "https://relay.stemstr.app/admin/login",
+			expected: false,
+		},
+		{
+			name:     "cross origin referer",
+			referer:  "https://evil.example/relay.stemstr.app",
+			expected: false,
+		},
+		{
+			name:     "null origin",
+			origin:   "null",
+			expected: false,
+		},
+		{
+			name:     "neither",
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "https://relay.stemstr.app/admin/login", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.referer != "" {
+				r.Header.Set("Referer", tt.referer)
+			}
+			assert.Equal(t, tt.expected, sameOrigin(r))
+		})
+	}
+}
+
+func TestSafeRedirect(t *testing.T) {
+	assert.Equal(t, "/admin?kind=1", safeRedirect("/admin?kind=1"))
+	assert.Equal(t, "/admin/audit", safeRedirect("/admin/audit"))
+	assert.Equal(t, "/admin", safeRedirect(""))
+	assert.Equal(t, "/admin", safeRedirect("https://example.com/admin"))
+	assert.Equal(t, "/admin", safeRedirect("//example.com"))
+	assert.Equal(t, "/admin", safeRedirect("/admin/login?next=/admin"))
+}
+
+func TestAdminLoginHandler(t *testing.T) {
+	a := testAdminAuth(t, time.Now())
+	handler := adminLoginHandler(Config{}, a, nil)
+
+	post := func(username, password string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {username}, "password": {password}, "next": {"/admin/audit"}}
+		r := httptest.NewRequest(http.MethodPost, "/admin/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Origin", "http://example.com")
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	w := post("alice", "wrong")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid username or password")
+	assert.Empty(t, w.Result().Cookies())
+
+	w = post("alice", "secret")
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/admin/audit", w.Header().Get("Location"))
+
+	cookies := w.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	assert.Equal(t, adminSessionCookie, cookies[0].Name)
+	assert.True(t, cookies[0].HttpOnly)
+	assert.Equal(t, http.SameSiteStrictMode, cookies[0].SameSite)
+
+	r := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	r.AddCookie(cookies[0])
+	session, ok := a.session(r)
+	assert.True(t, ok)
+	assert.Equal(t, "alice", session.user)
+
+	// Another site can't sign the browser in
+	form := url.Values{"username": {"alice"}, "password": {"secret"}}
+	r = httptest.NewRequest(http.MethodPost, "/admin/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Origin", "https://evil.example")
+	w = httptest.NewRecorder()
+	handler(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Result().Cookies())
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// defaultAttestationMaxTTL is how far in the future an attestation may
+// expire when attestation.max_ttl isn't configured.
+const defaultAttestationMaxTTL = 24 * time.Hour
+
+// An attestation is a short-lived token issued by a client's backend to one
+// of its signed in users, carried in a tag:
+//
+//	["attestation", "<client>", "<expires_at unix>", "<schnorr sig hex>"]
+//
+// The signature is over attestationHash and made with a key configured for
+// the client. It's bound to the event author, so a leaked token can't be
+// used by anyone else, and expires so it can't be used for long.
+
+// attestationHash is what an attestation signs.
+func attestationHash(client, pubkey string, expiresAt int64) [32]byte {
+	return sha256.Sum256([]byte(fmt.Sprintf("nostr-client-attestation:%s:%s:%d", client, pubkey, expiresAt)))
+}
+
+// attestationVerifier checks that events were published from a trusted
+// client.
+type attestationVerifier struct {
+	// clients maps client names to the keys their attestations are signed
+	// with.
+	clients map[string][]*btcec.PublicKey
+	maxTTL  time.Duration
+	// require ignores the unsigned client tag. Until it is set, a
+	// stemstr.app client tag is still trusted so clients can migrate.
+	require bool
+	now     func() time.Time
+}
+
+func newAttestationVerifier(cfg AttestationConfig) (*attestationVerifier, error) {
+	v := &attestationVerifier{
+		clients: make(map[string][]*btcec.PublicKey),
+		maxTTL:  cfg.MaxTTL,
+		require: cfg.Require,
+		now:     time.Now,
+	}
+	if v.maxTTL <= 0 {
+		v.maxTTL = defaultAttestationMaxTTL
+	}
+
+	for client, pubkeys := range cfg.Clients {
+		for _, pubkey := range pubkeys {
+			b, err := hex.DecodeString(pubkey)
+			if err != nil {
+				return nil, fmt.Errorf("attestation key %q for %s: %w", pubkey, client, err)
+			}
+			key, err := schnorr.ParsePubKey(b)
+			if err != nil {
+				return nil, fmt.Errorf("attestation key %q for %s: %w", pubkey, client, err)
+			}
+			v.clients[client] = append(v.clients[client], key)
+		}
+	}
+
+	return v, nil
+}
+
+// trusted reports whether evt carries a valid attestation from a trusted
+// client. It is safe to call on a nil *attestationVerifier, which only
+// checks the client tag.
+func (v *attestationVerifier) trusted(evt *nostr.Event) bool {
+	if v == nil {
+		return fromStemstrClient(evt)
+	}
+
+	for _, tag := range evt.Tags {
+		if len(tag) < 4 || tag[0] != "attestation" {
+			continue
+		}
+		if err := v.verify(evt.PubKey, tag[1], tag[2], tag[3]); err != nil {
+			log.Printf("event %s attestation: %v\n", evt.ID, err)
+			continue
+		}
+
+		return true
+	}
+
+	return !v.require && fromStemstrClient(evt)
+}
+
+func (v *attestationVerifier) verify(pubkey, client, expiresAtStr, sigHex string) error {
+	keys, ok := v.clients[client]
+	if !ok {
+		return fmt.Errorf("untrusted client %q", client)
+	}
+
+	expiresAt, err := strconv.ParseInt(expiresAtStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid expiry %q", expiresAtStr)
+	}
+	now := v.now()
+	if expiry := time.Unix(expiresAt, 0); !now.Before(expiry) {
+		return fmt.Errorf("expired at %d", expiresAt)
+	} else if expiry.Sub(now) > v.maxTTL {
+		return fmt.Errorf("expiry %d is too far in the future", expiresAt)
+	}
+
+	b, err := hex.DecodeString(sigHex)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+	sig, err := schnorr.ParseSignature(b)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+
+	hash := attestationHash(client, pubkey, expiresAt)
+	for _, key := range keys {
+		if sig.Verify(hash[:], key) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("signature not made by a key of %q", client)
+}
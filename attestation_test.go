@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/hex"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+// attestationTag signs an attestation tag the way a client's backend does.
+func attestationTag(t *testing.T, sk, client, pubkey string, expiresAt int64) nostr.Tag {
+	b, err := hex.DecodeString(sk)
+	assert.NoError(t, err)
+	key, _ := btcec.PrivKeyFromBytes(b)
+
+	hash := attestationHash(client, pubkey, expiresAt)
+	sig, err := schnorr.Sign(key, hash[:])
+	assert.NoError(t, err)
+
+	return nostr.Tag{"attestation", client, strconv.FormatInt(expiresAt, 10), hex.EncodeToString(sig.Serialize())}
+}
+
+func TestAttestationVerifier(t *testing.T) {
+	const authorPubkey = "e6230af84359c4bedd38207a349dfbf8d25ad3b767518e7231fcae03907b9282"
+
+	stemstrSK := nostr.GeneratePrivateKey()
+	stemstrPK, _ := nostr.GetPublicKey(stemstrSK)
+	partnerSK := nostr.GeneratePrivateKey()
+	partnerPK, _ := nostr.GetPublicKey(partnerSK)
+	otherSK := nostr.GeneratePrivateKey()
+
+	now := time.Unix(1690000000, 0)
+	valid := now.Add(time.Hour).Unix()
+
+	var tests = []struct {
+		name     string
+		require  bool
+		tags     nostr.Tags
+		expected bool
+	}{
+		{
+			name:     "stemstr attestation",
+			require:  true,
+			tags:     nostr.Tags{attestationTag(t, stemstrSK, "stemstr.app", authorPubkey, valid)},
+			expected: true,
+		},
+		{
+			name:     "trusted third party client",
+			require:  true,
+			tags:     nostr.Tags{attestationTag(t, partnerSK, "partner.app", authorPubkey, valid)},
+			expected: true,
+		},
+		{
+			name:     "signed by another key",
+			require:  true,
+			tags:     nostr.Tags{attestationTag(t, otherSK, "stemstr.app", authorPubkey, valid)},
+			expected: false,
+		},
+		{
+			name:     "key of another client",
+			require:  true,
+			tags:     nostr.Tags{attestationTag(t, partnerSK, "stemstr.app", authorPubkey, valid)},
+			expected: false,
+		},
+		{
+			name:     "untrusted client",
+			require:  true,
+			tags:     nostr.Tags{attestationTag(t, otherSK, "other.app", authorPubkey, valid)},
+			expected: false,
+		},
+		{
+			name:     "issued to another pubkey",
+			require:  true,
+			tags:     nostr.Tags{attestationTag(t, stemstrSK, "stemstr.app", stemstrHexpub, valid)},
+			expected: false,
+		},
+		{
+			name:     "expired",
+			require:  true,
+			tags:     nostr.Tags{attestationTag(t, stemstrSK, "stemstr.app", authorPubkey, now.Add(-time.Minute).Unix())},
+			expected: false,
+		},
+		{
+			name:     "expires too far in the future",
+			require:  true,
+			tags:     nostr.Tags{attestationTag(t, stemstrSK, "stemstr.app", authorPubkey, now.Add(48*time.Hour).Unix())},
+			expected: false,
+		},
+		{
+			name:     "malformed signature",
+			require:  true,
+			tags:     nostr.Tags{{"attestation", "stemstr.app", strconv.FormatInt(valid, 10), "nothex"}},
+			expected: false,
+		},
+		{
+			name:     "client tag when required",
+			require:  true,
+			tags:     nostr.Tags{{"client", "stemstr.app"}},
+			expected: false,
+		},
+		{
+			name:     "client tag while migrating",
+			tags:     nostr.Tags{{"client", "stemstr.app"}},
+			expected: true,
+		},
+		{
+			name:     "nothing",
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := newAttestationVerifier(AttestationConfig{
+				Clients: map[string][]string{
+					"stemstr.app": {stemstrPK},
+					"partner.app": {partnerPK},
+				},
+				Require: tt.require,
+			})
+			assert.NoError(t, err)
+			v.now = func() time.Time { return now }
+
+			evt := &nostr.Event{PubKey: authorPubkey, Kind: 1808, Tags: tt.tags}
+			assert.Equal(t, tt.expected, v.trusted(evt))
+		})
+	}
+}
+
+func TestAttestationVerifierNil(t *testing.T) {
+	var v *attestationVerifier
+
+	assert.True(t, v.trusted(&nostr.Event{Tags: nostr.Tags{{"client", "stemstr.app"}}}))
+	assert.False(t, v.trusted(&nostr.Event{}))
+}
+
+func TestNewAttestationVerifierInvalidKey(t *testing.T) {
+	_, err := newAttestationVerifier(AttestationConfig{
+		Clients: map[string][]string{"stemstr.app": {"nothex"}},
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	defaultAuditListLimit   = 100
+	defaultAuditExportLimit = 10000
+
+	// auditMaxEventIDs is the most affected event ids recorded for an
+	// action. Larger actions only record their count and filter.
+	auditMaxEventIDs = 1000
+)
+
+// auditEntry records an admin action.
+type auditEntry struct {
+	ID     int64  `db:"id" json:"id"`
+	Admin  string `db:"admin" json:"admin"`
+	Action string `db:"action" json:"action"`
+	// Target is the event id, pubkey or entry the action was about.
+	Target string `db:"target" json:"target"`
+	// Params are the request's query and form params, and the details the
+	// handler recorded with setAuditDetail.
+	Params    json.RawMessage `db:"params" json:"params"`
+	Status    int             `db:"status" json:"status"`
+	IP        string          `db:"ip" json:"ip"`
+	CreatedAt time.Time       `db:"created_at" json:"created_at"`
+}
+
+// auditQuery filters audit entries. Empty fields match everything.
+type auditQuery struct {
+	Admin  string
+	Action string
+	Target string
+	Since  *time.Time
+	Until  *time.Time
+	Limit  int
+}
+
+// auditLog is an append-only Postgres table of admin actions.
+type auditLog struct {
+	db *sqlx.DB
+}
+
+func newAuditLog(db *sqlx.DB) (*auditLog, error) {
+	_, err := db.Exec(`
+CREATE TABLE IF NOT EXISTS admin_audit (
+  id bigserial PRIMARY KEY,
+  admin text NOT NULL,
+  action text NOT NULL,
+  target text NOT NULL DEFAULT '',
+  params jsonb NOT NULL DEFAULT '{}',
+  status integer NOT NULL,
+  ip text NOT NULL DEFAULT '',
+  created_at timestamptz NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS admin_audit_created_at ON admin_audit (created_at);
+
+CREATE OR REPLACE RULE admin_audit_no_update AS ON UPDATE TO admin_audit DO INSTEAD NOTHING;
+CREATE OR REPLACE RULE admin_audit_no_delete AS ON DELETE TO admin_audit DO INSTEAD NOTHING;
+`)
+	if err != nil {
+		return nil, fmt.Errorf("create table: %w", err)
+	}
+
+	return &auditLog{db: db}, nil
+}
+
+func (a *auditLog) record(ctx context.Context, e auditEntry) error {
+	_, err := a.db.ExecContext(ctx, `INSERT INTO admin_audit (admin, action, target, params, status, ip)
+VALUES ($1, $2, $3, $4, $5, $6)`, e.Admin, e.Action, e.Target, e.Params, e.Status, e.IP)
+	if err != nil {
+		return fmt.Errorf("insert audit: %w", err)
+	}
+
+	return nil
+}
+
+// list returns the latest entries matching q.
+func (a *auditLog) list(ctx context.Context, q auditQuery) ([]auditEntry, error) {
+	var entries []auditEntry
+	err := a.db.SelectContext(ctx, &entries, `SELECT id, admin, action, target, params, status, ip, created_at
+FROM admin_audit
+WHERE ($1 = '' OR admin = $1)
+  AND ($2 = '' OR action = $2)
+  AND ($3 = '' OR target = $3)
+  AND ($4::timestamptz IS NULL OR created_at >= $4)
+  AND ($5::timestamptz IS NULL OR created_at <= $5)
+ORDER BY id DESC
+LIMIT $6`, q.Admin, q.Action, q.Target, q.Since, q.Until, q.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("select audit: %w", err)
+	}
+
+	return entries, nil
+}
+
+// parseAuditQuery reads the admin, action, target, since, until and limit
+// params.
+func parseAuditQuery(v url.Values, defaultLimit int) (auditQuery, error) {
+	q := auditQuery{
+		Admin:  v.Get("admin"),
+		Action: v.Get("action"),
+		Target: v.Get("target"),
+		Limit:  defaultLimit,
+	}
+
+	if limitStr := v.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 {
+			return q, fmt.Errorf("invalid limit %q", limitStr)
+		}
+		q.Limit = limit
+	}
+	if sinceStr := v.Get("since"); sinceStr != "" {
+		since, err := parseAdminTime(sinceStr)
+		if err != nil {
+			return q, fmt.Errorf("invalid since %q", sinceStr)
+		}
+		t := since.Time()
+		q.Since = &t
+	}
+	if untilStr := v.Get("until"); untilStr != "" {
+		until, err := parseAdminTime(untilStr)
+		if err != nil {
+			return q, fmt.Errorf("invalid until %q", untilStr)
+		}
+		t := until.Time()
+		q.Until = &t
+	}
+
+	return q, nil
+}
+
+// statusRecorder remembers the status code written to a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+type auditDetailsKey struct{}
+
+// auditDetails are what a handler found out about the action it took, e.g.
+// the events it affected, beyond the request's params.
+type auditDetails map[string]any
+
+// setAuditDetail records value under key in the audit entry for r, if it is
+// audited.
+func setAuditDetail(r *http.Request, key string, value any) {
+	if details, ok := r.Context().Value(auditDetailsKey{}).(auditDetails); ok {
+		details[key] = value
+	}
+}
+
+// audited records requests to next in the audit log as action, taking the
+// target from the targetParam param. Requests that didn't get past
+// authentication or used the wrong method aren't recorded.
+func audited(cfg Config, a *auditLog, action, targetParam string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		details := make(auditDetails)
+		r = r.WithContext(context.WithValue(r.Context(), auditDetailsKey{}, details))
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+
+		if a == nil || rec.status == http.StatusUnauthorized || rec.status == http.StatusMethodNotAllowed {
+			return
+		}
+
+		entry := newAuditEntry(r, action, targetParam, rec.status, cfg.RateLimits.TrustForwardedFor)
+		if err := a.record(context.Background(), entry); err != nil {
+			log.Printf("[error] audit %s by %s: %v\n", action, entry.Admin, err)
+		}
+	}
+}
+
+// newAuditEntry describes the admin request r, which got status.
+func newAuditEntry(r *http.Request, action, targetParam string, status int, trustForwardedFor bool) auditEntry {
+	// The handler has usually parsed the form already
+	if err := r.ParseForm(); err != nil {
+		log.Printf("[error] audit %s: parse form: %v\n", action, err)
+	}
+	all := make(map[string]any, len(r.Form))
+	for k, v := range r.Form {
+		all[k] = v
+	}
+	details, _ := r.Context().Value(auditDetailsKey{}).(auditDetails)
+	for k, v := range details {
+		all[k] = v
+	}
+	params, err := json.Marshal(all)
+	if err != nil {
+		log.Printf("[error] audit %s: marshal params: %v\n", action, err)
+		params = []byte("{}")
+	}
+
+	return auditEntry{
+		Admin:  adminName(r),
+		Action: action,
+		Target: r.Form.Get(targetParam),
+		Params: params,
+		Status: status,
+		IP:     clientIP(r, trustForwardedFor),
+	}
+}
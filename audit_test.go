@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAuditQuery(t *testing.T) {
+	since := time.Unix(1690000000, 0)
+	until := time.Date(2023, 7, 23, 12, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		name        string
+		query       string
+		expected    auditQuery
+		expectedErr bool
+	}{
+		{
+			name:     "nothing",
+			query:    "",
+			expected: auditQuery{Limit: 100},
+		},
+		{
+			name:  "all params",
+			query: "admin=alice&action=delete_event&target=abc&since=1690000000&until=2023-07-23T12:00&limit=10",
+			expected: auditQuery{
+				Admin:  "alice",
+				Action: "delete_event",
+				Target: "abc",
+				Since:  &since,
+				Until:  &until,
+				Limit:  10,
+			},
+		},
+		{
+			name:        "invalid limit",
+			query:       "limit=-1",
+			expectedErr: true,
+		},
+		{
+			name:        "invalid until",
+			query:       "until=tomorrow",
+			expectedErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := url.ParseQuery(tt.query)
+			assert.NoError(t, err)
+
+			q, err := parseAuditQuery(v, 100)
+			if tt.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected.Admin, q.Admin)
+			assert.Equal(t, tt.expected.Action, q.Action)
+			assert.Equal(t, tt.expected.Target, q.Target)
+			assert.Equal(t, tt.expected.Limit, q.Limit)
+			if tt.expected.Since == nil {
+				assert.Nil(t, q.Since)
+			} else {
+				assert.True(t, tt.expected.Since.Equal(*q.Since))
+			}
+			if tt.expected.Until == nil {
+				assert.Nil(t, q.Until)
+			} else {
+				assert.True(t, tt.expected.Until.Equal(*q.Until))
+			}
+		})
+	}
+}
+
+func TestNewAuditEntry(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/admin/access/add?list=block", strings.NewReader("type=pubkey&value=abc&reason=spam"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.7")
+	r.RemoteAddr = "10.0.0.1:1234"
+	r = r.WithContext(context.WithValue(r.Context(), adminSessionKey{}, adminSession{user: "alice"}))
+
+	entry := newAuditEntry(r, "add_access_entry", "value", http.StatusOK, true)
+	assert.Equal(t, "alice", entry.Admin)
+	assert.Equal(t, "add_access_entry", entry.Action)
+	assert.Equal(t, "abc", entry.Target)
+	assert.Equal(t, http.StatusOK, entry.Status)
+	assert.Equal(t, "203.0.113.7", entry.IP)
+
+	var params map[string][]string
+	assert.NoError(t, json.Unmarshal(entry.Params, &params))
+	assert.Equal(t, map[string][]string{
+		"list":   {"block"},
+		"type":   {"pubkey"},
+		"value":  {"abc"},
+		"reason": {"spam"},
+	}, params)
+}
+
+func TestNewAuditEntryDetails(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/admin/bulk?action=delete&pubkey=abc&kind=1", nil)
+	// Requests that aren't audited ignore details
+	setAuditDetail(r, "count", 1)
+
+	r = r.WithContext(context.WithValue(r.Context(), auditDetailsKey{}, make(auditDetails)))
+	setAuditDetail(r, "filter", nostr.Filter{Kinds: []int{1}, Authors: []string{"abc"}})
+	setAuditDetail(r, "count", 2)
+	setAuditDetail(r, "event_ids", []string{"e1", "e2"})
+
+	entry := newAuditEntry(r, "bulk", "pubkey", http.StatusOK, false)
+	assert.Equal(t, "abc", entry.Target)
+	assert.JSONEq(t, `{
+		"action": ["delete"],
+		"pubkey": ["abc"],
+		"kind": ["1"],
+		"filter": {"kinds": [1], "authors": ["abc"]},
+		"count": 2,
+		"event_ids": ["e1", "e2"]
+	}`, string(entry.Params))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/fiatjaf/relayer/v2"
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	reasonAuthRequired = "auth-required: publishing this kind requires NIP-42 authentication"
+	reasonAuthMismatch = "restricted: authenticated pubkey does not match event author"
+)
+
+// ServiceURL implements relayer.Auther. Clients are sent a NIP-42 challenge
+// on connect and must sign it for this relay URL.
+func (r Relay) ServiceURL() string {
+	return r.cfg.Auth.ServiceURL
+}
+
+// validate returns an error if authentication is required without a service
+// URL. Every AUTH event would fail to verify against it, so nobody could
+// publish or read the gated kinds.
+func (c AuthConfig) validate() error {
+	if c.ServiceURL == "" && (c.RequireForPublish || len(c.RequireForReadKinds) > 0) {
+		return errors.New("service_url is required when require_for_publish or require_for_read_kinds is set")
+	}
+
+	return nil
+}
+
+type adminContextKey struct{}
+
+// adminContext marks ctx as coming from the admin UI, which may read every
+// kind without authenticating over NIP-42.
+func adminContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, adminContextKey{}, true)
+}
+
+func isAdminContext(ctx context.Context) bool {
+	admin, _ := ctx.Value(adminContextKey{}).(bool)
+	return admin
+}
+
+// authedPubkey returns the NIP-42 authenticated pubkey of the connection ctx
+// was created for. Our relayer fork attaches it to the context of every
+// message the connection sends after authenticating.
+func authedPubkey(ctx context.Context) (string, bool) {
+	pubkey, ok := relayer.GetAuthStatus(ctx)
+	if !ok || pubkey == "" {
+		return "", false
+	}
+
+	return pubkey, true
+}
+
+// authPolicy requires the author of subscription-required kinds to have
+// authenticated the connection as themselves.
+type authPolicy struct {
+	requireForPublish bool
+	subscriptionKinds []int
+}
+
+func (p authPolicy) Name() string { return "auth" }
+
+func (p authPolicy) Evaluate(ctx context.Context, evt *nostr.Event) (bool, string) {
+	if !p.requireForPublish || !kindRequiresSubscription(p.subscriptionKinds, evt.Kind) {
+		return true, ""
+	}
+
+	pubkey, ok := authedPubkey(ctx)
+	if !ok {
+		return false, reasonAuthRequired
+	}
+	if pubkey != evt.PubKey {
+		return false, reasonAuthMismatch
+	}
+
+	return true, ""
+}
+
+// readGate restricts reading some kinds to connections authenticated as a
+// subscribed pubkey.
+type readGate struct {
+	kinds        []int
+	isSubscribed func(pubkey string) (bool, error)
+}
+
+func (g *readGate) restricts(kind int) bool {
+	for _, k := range g.kinds {
+		if kind == k {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authorized reports whether the connection behind ctx may read restricted
+// kinds.
+func (g *readGate) authorized(ctx context.Context) bool {
+	if isAdminContext(ctx) {
+		return true
+	}
+
+	pubkey, ok := authedPubkey(ctx)
+	if !ok {
+		return false
+	}
+
+	subscribed, err := g.isSubscribed(pubkey)
+	if err != nil {
+		log.Printf("isSubscribed: %v\n", err)
+		return false
+	}
+
+	return subscribed
+}
+
+// allows reports whether the connection behind ctx may read event. It is
+// safe to call on a nil *readGate.
+func (g *readGate) allows(ctx context.Context, event *nostr.Event) bool {
+	return g == nil || !g.restricts(event.Kind) || g.authorized(ctx)
+}
+
+// conditions is the SQL condition leaving restricted kinds out of queries
+// and counts unless ctx is authorized. It is safe to call on a nil
+// *readGate.
+func (g *readGate) conditions(ctx context.Context) (string, []any) {
+	if g == nil || g.authorized(ctx) {
+		return "", nil
+	}
+
+	kinds := make(pq.Int64Array, len(g.kinds))
+	for i, kind := range g.kinds {
+		kinds[i] = int64(kind)
+	}
+
+	return "kind <> ALL(?)", []any{kinds}
+}
+
+// AllowLiveEvent implements relayer.LiveEventFilter, holding restricted
+// kinds back from live subscriptions as they are from stored results, and
+// everything back from connections whose IP has since been blocked.
+func (r Relay) AllowLiveEvent(ctx context.Context, event *nostr.Event) bool {
+	if ip, ok := connectionIP(ctx); ok {
+		if allowed, _ := r.storage.access.allowIP(ip); !allowed {
+			return false
+		}
+	}
+
+	return r.storage.readGate.allows(ctx, event)
+}
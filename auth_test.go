@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/relayer/v2"
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip42"
+	"github.com/stretchr/testify/assert"
+)
+
+const authedTestPubkey = "e6230af84359c4bedd38207a349dfbf8d25ad3b767518e7231fcae03907b9282"
+
+func authedContext(pubkey string) context.Context {
+	return context.WithValue(context.Background(), relayer.AUTH_CONTEXT_KEY, pubkey)
+}
+
+func TestAuthPolicy(t *testing.T) {
+	var tests = []struct {
+		name              string
+		requireForPublish bool
+		ctx               context.Context
+		event             *nostr.Event
+		expected          bool
+	}{
+		{
+			name:     "auth not required",
+			ctx:      context.Background(),
+			event:    &nostr.Event{Kind: 1808, PubKey: authedTestPubkey},
+			expected: true,
+		},
+		{
+			name:              "kind does not require sub",
+			requireForPublish: true,
+			ctx:               context.Background(),
+			event:             &nostr.Event{Kind: nostr.KindReaction, PubKey: authedTestPubkey},
+			expected:          true,
+		},
+		{
+			name:              "not authenticated",
+			requireForPublish: true,
+			ctx:               context.Background(),
+			event:             &nostr.Event{Kind: 1808, PubKey: authedTestPubkey},
+			expected:          false,
+		},
+		{
+			name:              "authenticated as author",
+			requireForPublish: true,
+			ctx:               authedContext(authedTestPubkey),
+			event:             &nostr.Event{Kind: 1808, PubKey: authedTestPubkey},
+			expected:          true,
+		},
+		{
+			name:              "authenticated as someone else",
+			requireForPublish: true,
+			ctx:               authedContext(stemstrHexpub),
+			event:             &nostr.Event{Kind: 1808, PubKey: authedTestPubkey},
+			expected:          false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := authPolicy{
+				requireForPublish: tt.requireForPublish,
+				subscriptionKinds: subRequiredKinds,
+			}
+			ok, _ := p.Evaluate(tt.ctx, tt.event)
+			assert.Equal(t, tt.expected, ok)
+		})
+	}
+}
+
+func TestAuthConfigValidate(t *testing.T) {
+	var tests = []struct {
+		name        string
+		cfg         AuthConfig
+		expectedErr bool
+	}{
+		{
+			name: "not required",
+		},
+		{
+			name: "required with service url",
+			cfg:  AuthConfig{ServiceURL: "wss://relay.stemstr.app", RequireForPublish: true, RequireForReadKinds: []int{1808}},
+		},
+		{
+			name:        "required for publish without service url",
+			cfg:         AuthConfig{RequireForPublish: true},
+			expectedErr: true,
+		},
+		{
+			name:        "required for read without service url",
+			cfg:         AuthConfig{RequireForReadKinds: []int{1808}},
+			expectedErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validate()
+			if tt.expectedErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestReadGate(t *testing.T) {
+	var tests = []struct {
+		name               string
+		ctx                context.Context
+		subscribed         bool
+		expectedKinds      []int
+		expectedConditions bool
+	}{
+		{
+			name:               "not authenticated",
+			ctx:                context.Background(),
+			expectedKinds:      []int{1, 7},
+			expectedConditions: true,
+		},
+		{
+			name:               "authenticated without sub",
+			ctx:                authedContext(authedTestPubkey),
+			expectedKinds:      []int{1, 7},
+			expectedConditions: true,
+		},
+		{
+			name:          "authenticated subscriber",
+			ctx:           authedContext(authedTestPubkey),
+			subscribed:    true,
+			expectedKinds: []int{1, 1808, 7},
+		},
+		{
+			name:          "admin",
+			ctx:           adminContext(context.Background()),
+			expectedKinds: []int{1, 1808, 7},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &readGate{
+				kinds: []int{1808},
+				isSubscribed: func(pubkey string) (bool, error) {
+					return tt.subscribed, nil
+				},
+			}
+
+			var kinds []int
+			for _, kind := range []int{1, 1808, 7} {
+				if g.allows(tt.ctx, &nostr.Event{Kind: kind}) {
+					kinds = append(kinds, kind)
+				}
+			}
+			assert.Equal(t, tt.expectedKinds, kinds)
+
+			condition, params := g.conditions(tt.ctx)
+			if tt.expectedConditions {
+				assert.Equal(t, "kind <> ALL(?)", condition)
+				assert.Equal(t, []any{pq.Int64Array{1808}}, params)
+			} else {
+				assert.Empty(t, condition)
+			}
+		})
+	}
+
+	var nilGate *readGate
+	assert.True(t, nilGate.allows(context.Background(), &nostr.Event{Kind: 1808}))
+	condition, _ := nilGate.conditions(context.Background())
+	assert.Empty(t, condition)
+}
+
+// authTestRelay serves authPolicy and readGate from memory, so they can be
+// tested through a real relayer.Server.
+type authTestRelay struct {
+	serviceURL string
+	policy     authPolicy
+	gate       *readGate
+	// store, if set, refuses reads as the relay's storage does.
+	store *storage
+
+	mu     sync.Mutex
+	events []*nostr.Event
+	// ip is the client IP the last SaveEvent saw.
+	ip string
+}
+
+func (r *authTestRelay) Name() string                                   { return "auth test relay" }
+func (r *authTestRelay) Init() error                                    { return nil }
+func (r *authTestRelay) ServiceURL() string                             { return r.serviceURL }
+func (r *authTestRelay) AcceptEvent(context.Context, *nostr.Event) bool { return true }
+func (r *authTestRelay) Storage(context.Context) relayer.Storage        { return r }
+func (r *authTestRelay) DeleteEvent(context.Context, string, string) error {
+	return nil
+}
+
+func (r *authTestRelay) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	if ok, reason := r.policy.Evaluate(ctx, evt); !ok {
+		return errors.New(reason)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, evt)
+	r.ip, _ = connectionIP(ctx)
+	return nil
+}
+
+func (r *authTestRelay) QueryEvents(ctx context.Context, filter *nostr.Filter) (chan *nostr.Event, error) {
+	if r.store != nil {
+		if err := r.store.allowRead(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	events := make(chan *nostr.Event, len(r.events))
+	for _, evt := range r.events {
+		if filter.Matches(evt) && r.gate.allows(ctx, evt) {
+			events <- evt
+		}
+	}
+	close(events)
+
+	return events, nil
+}
+
+func (r *authTestRelay) AllowLiveEvent(ctx context.Context, evt *nostr.Event) bool {
+	return r.gate.allows(ctx, evt)
+}
+
+func TestAuthThroughServer(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pubkey, err := nostr.GetPublicKey(sk)
+	assert.NoError(t, err)
+
+	stored := &nostr.Event{ID: "stored", PubKey: stemstrHexpub, Kind: 1808}
+	r := &authTestRelay{
+		policy: authPolicy{requireForPublish: true, subscriptionKinds: subRequiredKinds},
+		gate: &readGate{
+			kinds: []int{1808},
+			isSubscribed: func(p string) (bool, error) {
+				return p == pubkey, nil
+			},
+		},
+		events: []*nostr.Event{stored},
+	}
+	server, err := relayer.NewServer(r)
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	r.serviceURL = "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	// go-nostr's client drops the challenge sent right after connecting, so
+	// talk to the server directly.
+	dial := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(r.serviceURL, nil)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		return conn
+	}
+	read := func(conn *websocket.Conn) (label string, msg []json.RawMessage) {
+		assert.NoError(t, conn.ReadJSON(&msg))
+		assert.NoError(t, json.Unmarshal(msg[0], &label))
+		return label, msg
+	}
+	// publish returns the OK message's reason.
+	publish := func(conn *websocket.Conn, label string, evt nostr.Event) (bool, string) {
+		assert.NoError(t, conn.WriteJSON([]any{label, evt}))
+		var ok bool
+		var reason string
+		for {
+			typ, msg := read(conn)
+			if typ == "OK" {
+				json.Unmarshal(msg[2], &ok)
+				if len(msg) > 3 {
+					json.Unmarshal(msg[3], &reason)
+				}
+				return ok, reason
+			}
+		}
+	}
+	// query returns the ids of the stored events matching kinds, leaving
+	// the subscription open.
+	query := func(conn *websocket.Conn, kinds ...int) []string {
+		assert.NoError(t, conn.WriteJSON([]any{"REQ", "tracks", nostr.Filter{Kinds: kinds}}))
+		var ids []string
+		for {
+			typ, msg := read(conn)
+			if typ == "EOSE" {
+				return ids
+			}
+			var evt nostr.Event
+			assert.NoError(t, json.Unmarshal(msg[2], &evt))
+			ids = append(ids, evt.ID)
+		}
+	}
+	sign := func(kind int) nostr.Event {
+		evt := nostr.Event{PubKey: pubkey, CreatedAt: nostr.Now(), Kind: kind, Tags: nostr.Tags{}}
+		assert.NoError(t, evt.Sign(sk))
+		return evt
+	}
+
+	conn := dial()
+	defer conn.Close()
+	label, msg := read(conn)
+	assert.Equal(t, "AUTH", label)
+	var challenge string
+	assert.NoError(t, json.Unmarshal(msg[1], &challenge))
+
+	ok, reason := publish(conn, "EVENT", sign(1808))
+	assert.False(t, ok)
+	assert.Equal(t, reasonAuthRequired, reason)
+	assert.Empty(t, query(conn, 1808))
+
+	// Another connection stays unauthenticated and listens for new events
+	other := dial()
+	defer other.Close()
+	label, _ = read(other)
+	assert.Equal(t, "AUTH", label)
+	assert.Empty(t, query(other, 1808, nostr.KindReaction))
+
+	authEvent := nip42.CreateUnsignedAuthEvent(challenge, pubkey, r.serviceURL)
+	assert.NoError(t, authEvent.Sign(sk))
+	ok, _ = publish(conn, "AUTH", authEvent)
+	assert.True(t, ok)
+
+	published := sign(1808)
+	ok, reason = publish(conn, "EVENT", published)
+	assert.True(t, ok, reason)
+	assert.ElementsMatch(t, []string{stored.ID, published.ID}, query(conn, 1808))
+
+	// The track isn't sent live to the unauthenticated connection, the
+	// reaction published after it is
+	reaction := sign(nostr.KindReaction)
+	ok, reason = publish(conn, "EVENT", reaction)
+	assert.True(t, ok, reason)
+	label, msg = read(other)
+	assert.Equal(t, "EVENT", label)
+	var live nostr.Event
+	assert.NoError(t, json.Unmarshal(msg[2], &live))
+	assert.Equal(t, reaction.ID, live.ID)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	assert.Equal(t, "127.0.0.1", r.ip)
+}
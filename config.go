@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -19,6 +20,250 @@ type Config struct {
 	BlastrNsec         string            `yaml:"blastr_nsec"`
 	BloomFilterSize    uint              `yaml:"bloom_filter_size"`
 	BloomFilterFP      float64           `yaml:"bloom_filter_fp"`
+	Policies           []string          `yaml:"policies"`
+	DisabledPolicies   []string          `yaml:"disabled_policies"`
+	Auth               AuthConfig        `yaml:"auth"`
+	// AdminAuth configures admin sessions and login lockouts.
+	AdminAuth AdminAuthConfig `yaml:"admin_auth"`
+
+	// SubscriptionNegativeCacheTTL is how long a pubkey without a
+	// subscription is cached before asking the subscriptions database again.
+	SubscriptionNegativeCacheTTL time.Duration `yaml:"subscription_negative_cache_ttl"`
+	// SubscriptionKinds overrides the kinds that require a subscription.
+	SubscriptionKinds []int `yaml:"subscription_kinds"`
+	// SubscriptionTiers maps subscription tiers to what they may publish.
+	// The "free" tier applies to pubkeys without a subscription.
+	SubscriptionTiers map[string]TierConfig `yaml:"subscription_tiers"`
+	// Nip05Gate lets unsubscribed authors publish subscription-required
+	// kinds if they have a NIP-05 identifier on an allowed domain.
+	Nip05Gate Nip05GateConfig `yaml:"nip05_gate"`
+	// WebOfTrust accepts replies, reactions and reposts from authors close
+	// to the seed pubkeys in the follow graph.
+	WebOfTrust WebOfTrustConfig `yaml:"web_of_trust"`
+	// SeenEventsSnapshotInterval is how often the seen events filter is
+	// saved so startup only has to scan newer events.
+	SeenEventsSnapshotInterval time.Duration `yaml:"seen_events_snapshot_interval"`
+	// SeenEventsSnapshotSlack is how far before the snapshot watermark
+	// events are rescanned on startup.
+	SeenEventsSnapshotSlack time.Duration `yaml:"seen_events_snapshot_slack"`
+	// SeenEventsWarnFP and SeenEventsWarnFillRatio are the estimated false
+	// positive rate and fill ratio above which the seen events filter logs
+	// a warning.
+	SeenEventsWarnFP        float64 `yaml:"seen_events_warn_fp"`
+	SeenEventsWarnFillRatio float64 `yaml:"seen_events_warn_fill_ratio"`
+	// ConfirmReferences checks referenced ids the seen events filter
+	// reports against the event table before accepting an event.
+	ConfirmReferences bool `yaml:"confirm_references"`
+	// TombstoneRetention is how long deleted event ids are kept to reject
+	// references to them. Older references are only caught with
+	// ConfirmReferences. Defaults to 90 days.
+	TombstoneRetention time.Duration `yaml:"tombstone_retention"`
+	// ReferenceCacheSize is how many confirmed ids are cached.
+	ReferenceCacheSize int `yaml:"reference_cache_size"`
+	// Share configures the notes announcing shared tracks.
+	Share ShareConfig `yaml:"share"`
+	// Attestation configures which clients are trusted to publish tracks
+	// and notes.
+	Attestation AttestationConfig `yaml:"attestation"`
+	// Limits bound the size and shape of events.
+	Limits EventLimits `yaml:"limits"`
+	// RateLimits limit publishing per pubkey and IP and connecting per IP.
+	RateLimits RateLimitConfig `yaml:"rate_limits"`
+}
+
+// AttestationConfig configures client attestations, short-lived tokens a
+// client's backend signs for its users to prove where an event came from.
+type AttestationConfig struct {
+	// Clients maps client names, e.g. stemstr.app, to the hex pubkeys
+	// their attestations may be signed with.
+	Clients map[string][]string `yaml:"clients"`
+	// MaxTTL is how far in the future an attestation may expire. It
+	// defaults to 24h.
+	MaxTTL time.Duration `yaml:"max_ttl"`
+	// Require ignores the unsigned client tag. Leave it off until every
+	// Stemstr client sends attestations.
+	Require bool `yaml:"require"`
+}
+
+// EventLimits bound the size and shape of accepted events. Zero values
+// other than MaxEventSize are not enforced.
+type EventLimits struct {
+	// MaxEventSize is the largest JSON encoding of an event, in bytes. It
+	// defaults to 10000.
+	MaxEventSize int `yaml:"max_event_size"`
+	// KindMaxEventSize overrides MaxEventSize for some kinds.
+	KindMaxEventSize map[int]int `yaml:"kind_max_event_size"`
+	MaxTags          int         `yaml:"max_tags"`
+	// MaxTagValueLength applies to every element of every tag.
+	MaxTagValueLength int `yaml:"max_tag_value_length"`
+	MaxContentLength  int `yaml:"max_content_length"`
+	// RequiredTags are the tags each kind must carry with a value. It
+	// defaults to url, m and x for 1063.
+	RequiredTags map[int][]string `yaml:"required_tags"`
+	// TrackMediaHosts, if set, are the only hosts 1808 stream and download
+	// URLs may point to, including their subdomains.
+	TrackMediaHosts []string `yaml:"track_media_hosts"`
+}
+
+// RateLimitConfig configures the relay's token buckets.
+type RateLimitConfig struct {
+	// Connection limits every message on a connection. Messages over the
+	// limit are delayed rather than rejected.
+	Connection RateLimit `yaml:"connection"`
+	// Events is the write bucket, limiting how fast each pubkey may publish
+	// each kind.
+	Events EventRateLimits `yaml:"events"`
+	// IPEvents limits how fast each client IP may publish each kind, so
+	// fresh keys don't get fresh buckets.
+	IPEvents EventRateLimits `yaml:"ip_events"`
+	// Reads is the read bucket, limiting how fast each client IP may send
+	// REQs. Unset means unlimited.
+	Reads RateLimit `yaml:"reads"`
+	// Connections limits how fast each client IP may open connections.
+	Connections RateLimit `yaml:"connections"`
+	// TrustForwardedFor takes the client IP from the X-Forwarded-For header
+	// set by our proxy. Only enable it behind a proxy.
+	TrustForwardedFor bool `yaml:"trust_forwarded_for"`
+	// ExemptPubkeys and ExemptIPs bypass the pubkey and IP limits, e.g. our
+	// bots. The Stemstr account and the blastr key are always exempt.
+	ExemptPubkeys []string `yaml:"exempt_pubkeys"`
+	ExemptIPs     []string `yaml:"exempt_ips"`
+}
+
+// EventRateLimits are per kind publish limits. Default applies to kinds
+// without their own limit; if unset those kinds aren't limited.
+type EventRateLimits struct {
+	Default RateLimit         `yaml:"default"`
+	Kinds   map[int]RateLimit `yaml:"kinds"`
+}
+
+// RateLimit is a token bucket refilling one token Every, holding at most
+// Burst tokens.
+type RateLimit struct {
+	Every time.Duration `yaml:"every"`
+	Burst int           `yaml:"burst"`
+}
+
+// ShareConfig configures the notes posted through blastr when a track is
+// shared.
+type ShareConfig struct {
+	// AccountPubkey is the hex pubkey credited in the note. It defaults to
+	// the Stemstr account.
+	AccountPubkey string `yaml:"account_pubkey"`
+	// Templates the note is rendered from. If empty, the Stemstr note is
+	// used.
+	Templates []ShareTemplate `yaml:"templates"`
+	// Rules decide which saved events are announced. The first matching
+	// rule that isn't throttled triggers. If empty, every 1808 is.
+	Rules []ShareRule `yaml:"rules"`
+}
+
+// ShareRule triggers an announcement for events meeting all of its
+// conditions.
+type ShareRule struct {
+	Name  string `yaml:"name"`
+	Kinds []int  `yaml:"kinds"`
+	// Tags the event must have, e.g. {"t": "remix"}.
+	Tags map[string]string `yaml:"tags"`
+	// Authors, if set, are the only pubkeys the rule applies to, e.g.
+	// verified artists.
+	Authors []string `yaml:"authors"`
+	// Reply only matches events referencing another event.
+	Reply bool `yaml:"reply"`
+	// FirstFromAuthor only matches the author's first event of its kind.
+	FirstFromAuthor bool `yaml:"first_from_author"`
+	// Template is the name of the template to render. If empty, one is
+	// chosen as if there were no rules.
+	Template string `yaml:"template"`
+	// Throttle is how long after triggering for an author the rule ignores
+	// their events.
+	Throttle time.Duration `yaml:"throttle"`
+}
+
+// ShareTemplate is a share note. Content and every tag value are Go
+// text/templates executed with the shared event, the author's Npub, the
+// event's Tags by name and the AccountPubkey and AccountNpub.
+type ShareTemplate struct {
+	Name string `yaml:"name"`
+	// Match, if set, picks this template over unconditional ones for events
+	// with all of these tag values, e.g. {"t": "remix"}.
+	Match   map[string]string `yaml:"match"`
+	Content string            `yaml:"content"`
+	// Tags whose value renders empty are left out.
+	Tags [][]string `yaml:"tags"`
+}
+
+// TierConfig is what a subscription tier may publish.
+type TierConfig struct {
+	// Kinds of SubscriptionKinds the tier may publish.
+	Kinds []int `yaml:"kinds"`
+	// MaxEventSize, if set, limits the size of events published by the tier.
+	MaxEventSize int `yaml:"max_event_size"`
+}
+
+// Nip05GateConfig configures the NIP-05 gate. It is off unless Domains is
+// set.
+type Nip05GateConfig struct {
+	// Domains whose identifiers are trusted, e.g. artist partners.
+	Domains []string `yaml:"domains"`
+	// CacheTTL and NegativeCacheTTL are how long verified and unverified
+	// pubkeys are cached. They default to 1h and 10m.
+	CacheTTL         time.Duration `yaml:"cache_ttl"`
+	NegativeCacheTTL time.Duration `yaml:"negative_cache_ttl"`
+	// Timeout bounds fetching the domain's nostr.json. It defaults to 5s.
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxConcurrentFetches caps the nostr.json fetches in flight. It
+	// defaults to 8.
+	MaxConcurrentFetches int `yaml:"max_concurrent_fetches"`
+}
+
+// WebOfTrustConfig configures the web of trust. It is off unless Seeds is
+// set.
+type WebOfTrustConfig struct {
+	// Seeds are the hex pubkeys trust starts from, e.g. stemstr's accounts.
+	Seeds []string `yaml:"seeds"`
+	// MaxHops is how many follows away from a seed an author may be. It
+	// defaults to 2.
+	MaxHops int `yaml:"max_hops"`
+	// RebuildInterval is how often contact lists are fetched again and the
+	// trusted pubkeys rebuilt. It defaults to 1h.
+	RebuildInterval time.Duration `yaml:"rebuild_interval"`
+}
+
+// AdminAuthConfig configures how admins sign in to the admin UI. Admins
+// maps their usernames to bcrypt or argon2id password hashes, e.g. from
+// relay -hash-password.
+type AdminAuthConfig struct {
+	// SessionSecret signs session cookies and CSRF tokens. It must be at
+	// least 32 bytes. If unset a random one is used, so sessions end on
+	// restart and only work on the instance that issued them.
+	SessionSecret secretValue `yaml:"session_secret"`
+	// SessionTTL is how long a login lasts. It defaults to 12h.
+	SessionTTL time.Duration `yaml:"session_ttl"`
+	// MaxFailures failed logins within FailureWindow lock out the client IP
+	// for LockoutDuration. They default to 5, 15m and 15m.
+	MaxFailures     int           `yaml:"max_failures"`
+	FailureWindow   time.Duration `yaml:"failure_window"`
+	LockoutDuration time.Duration `yaml:"lockout_duration"`
+}
+
+// secretValue is a config value kept out of the logged config.
+type secretValue string
+
+func (secretValue) GoString() string {
+	return `"[redacted]"`
+}
+
+// AuthConfig controls NIP-42 authentication.
+type AuthConfig struct {
+	// ServiceURL is the relay URL clients must sign in their AUTH event.
+	ServiceURL string `yaml:"service_url"`
+	// RequireForPublish requires subscription-required kinds to be published
+	// over a connection authenticated as the event author.
+	RequireForPublish bool `yaml:"require_for_publish"`
+	// RequireForReadKinds are only served to connections authenticated as a
+	// subscribed pubkey.
+	RequireForReadKinds []int `yaml:"require_for_read_kinds"`
 }
 
 // Load Config from a yaml file at path.
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -30,3 +31,8 @@ nip11_contact: fixme
 	assert.Equal(t, "fixme", cfg.Nip11Pubkey)
 	assert.Equal(t, "fixme", cfg.Nip11Contact)
 }
+
+func TestConfigRedactsSessionSecret(t *testing.T) {
+	cfg := Config{AdminAuth: AdminAuthConfig{SessionSecret: "0123456789abcdef0123456789abcdef"}}
+	assert.NotContains(t, fmt.Sprintf("%#v", cfg), "0123456789abcdef")
+}
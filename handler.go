@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
@@ -10,36 +11,355 @@ import (
 	"strings"
 	"time"
 
-	"github.com/fiatjaf/relayer/v2"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip19"
 )
 
-func adminHandler(cfg Config, db relayer.Storage) func(http.ResponseWriter, *http.Request) {
+func adminHandler(cfg Config, s *storage) func(http.ResponseWriter, *http.Request) {
 	const template = "admin.html"
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		if !auth(r, cfg.Admins) {
-			w.Header().Add("WWW-Authenticate", `Basic realm="username and password required"`)
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("Unauthorized"))
+		if !auth(r) {
+			writeUnauthorized(w)
+			return
+		}
+
+		filter, err := adminFilter(r.URL.Query())
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		events, err := getEvents(s, filter)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		renderTemplate(w, r, template, map[string]any{
+			"events": events,
+		})
+	}
+}
+
+// renderTemplate executes the named template with data, adding the CSP
+// nonce for its inline script and the CSRF token of the admin's session.
+func renderTemplate(w http.ResponseWriter, r *http.Request, name string, data map[string]any) {
+	t, ok := templates[name]
+	if !ok {
+		log.Printf("template %s not found", name)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("missing template"))
+		return
+	}
+
+	tkn := make([]byte, 16)
+	rand.Read(tkn)
+	nonce := fmt.Sprintf("%x", tkn)
+	csp := fmt.Sprintf("script-src: 'self' 'unsafe-inline' 'nonce-%s'", nonce)
+
+	data["nonce"] = nonce
+	if session, ok := sessionFromContext(r.Context()); ok {
+		data["csrf"] = session.csrf
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Content-Security-Policy", csp)
+	if err := t.Execute(w, data); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+	}
+}
+
+// adminDeleteHandler soft-deletes the event in the id query param. It can
+// be restored through adminModerationHandler.
+func adminDeleteHandler(cfg Config, s *storage) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Method, http.MethodDelete) {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !auth(r) {
+			writeUnauthorized(w)
 			return
 		}
 
 		var (
-			id       = r.URL.Query().Get("id")
-			kindStr  = r.URL.Query().Get("kind")
-			pk       = r.URL.Query().Get("pubkey")
-			limitStr = r.URL.Query().Get("limit")
+			id = r.URL.Query().Get("id")
 		)
 
-		var kind *int
-		if kindStr != "" {
-			if i, err := strconv.Atoi(kindStr); err == nil {
-				kind = &i
+		filter := nostr.Filter{}
+		if id != "" {
+			filter.IDs = []string{id}
+		}
+
+		if len(filter.IDs) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("must provide id param"))
+			return
+		}
+
+		ctx := adminContext(context.Background())
+		events, err := s.QueryEvents(ctx, &filter)
+		if err != nil {
+			fmt.Printf("[error] query events: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		for event := range events {
+			if err := s.moderation.setState(ctx, []string{event.ID}, moderationDeleted, adminName(r)); err != nil {
+				log.Printf("[error] delete event %s: %s\n", event.ID, err)
+			} else {
+				log.Printf("deleted event: %s\n", event.String())
 			}
 		}
 
+		w.WriteHeader(http.StatusNoContent)
+		w.Write([]byte(""))
+		return
+	}
+}
+
+// adminBulkHandler applies the action param (delete, hide, quarantine,
+// restore or export) to the events selected by the same params as
+// adminHandler, except limit: it applies to every matching event. With
+// dry_run=true it only reports how many events would be affected.
+func adminBulkHandler(cfg Config, s *storage) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Method, http.MethodPost) {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !auth(r) {
+			writeUnauthorized(w)
+			return
+		}
+
+		var (
+			action = r.URL.Query().Get("action")
+			dryRun = r.URL.Query().Get("dry_run") == "true"
+		)
+
+		if _, ok := bulkActionStates[action]; !ok && action != bulkActionExport {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("action must be delete, hide, quarantine, restore or export"))
+			return
+		}
+
+		filter, err := adminFilter(r.URL.Query())
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if !narrows(filter) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("must provide at least one of id, kind, pubkey, since, until or tag params"))
+			return
+		}
+
+		ctx := adminContext(r.Context())
+		events, err := selectAllEvents(ctx, s, filter, bulkMaxEvents)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		ids := make([]string, len(events))
+		for i, event := range events {
+			ids[i] = event.ID
+		}
+		// The limit is the page size, not part of the selection
+		selection := filter
+		selection.Limit = 0
+		setAuditDetail(r, "filter", selection)
+		setAuditDetail(r, "count", len(ids))
+		if len(ids) <= auditMaxEventIDs {
+			setAuditDetail(r, "event_ids", ids)
+		}
+
+		if dryRun {
+			writeBulkResult(w, action, true, ids)
+			return
+		}
+
+		if action == bulkActionExport {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="events-%d.jsonl"`, time.Now().Unix()))
+			enc := json.NewEncoder(w)
+			for _, event := range events {
+				if err := enc.Encode(event); err != nil {
+					log.Println(err)
+					return
+				}
+			}
+			return
+		}
+
+		if err := s.moderation.setState(ctx, ids, bulkActionStates[action], adminName(r)); err != nil {
+			log.Printf("[error] bulk %s: %v\n", action, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		log.Printf("bulk %s of %d events by %s\n", action, len(ids), adminName(r))
+		writeBulkResult(w, action, false, ids)
+	}
+}
+
+// adminModerationHandler sets the moderation state of the event in the id
+// query param to the state param. state=visible restores it.
+func adminModerationHandler(cfg Config, m *moderation) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Method, http.MethodPost) {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !auth(r) {
+			writeUnauthorized(w)
+			return
+		}
+
+		var (
+			id    = r.URL.Query().Get("id")
+			state = r.URL.Query().Get("state")
+		)
+		if id == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("must provide id param"))
+			return
+		}
+		if !validModerationState(state) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("state must be visible, hidden, quarantined or deleted"))
+			return
+		}
+
+		if err := m.setState(r.Context(), []string{id}, state, adminName(r)); err != nil {
+			log.Printf("[error] moderate event %s: %v\n", id, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		log.Printf("set moderation state of %s to %s by %s\n", id, state, adminName(r))
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeBulkResult(w http.ResponseWriter, action string, dryRun bool, ids []string) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{
+		"action":  action,
+		"dry_run": dryRun,
+		"count":   len(ids),
+		"ids":     ids,
+	}); err != nil {
+		log.Println(err)
+	}
+}
+
+func adminStatsHandler(cfg Config, relay *Relay) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			writeUnauthorized(w)
+			return
+		}
+
+		stats := map[string]any{
+			"subscription_cache": relay.subscriptions.stats(),
+			"seen_events":        relay.storage.seenEvents.stats(),
+			"tombstones":         relay.storage.tombstones.len(),
+		}
+		if relay.storage.references != nil {
+			stats["references"] = relay.storage.references.stats()
+		}
+		if relay.storage.wot != nil {
+			stats["web_of_trust"] = relay.storage.wot.stats()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// adminRateLimitsHandler shows the rate limiters' settings, usage and the
+// keys most often limited.
+func adminRateLimitsHandler(cfg Config, limits *rateLimiters) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			writeUnauthorized(w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(limits.stats()); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// adminInvalidateSubscriptionHandler drops the cached subscription status of
+// the pubkey query param, so a newly bought subscription is seen right away.
+func adminInvalidateSubscriptionHandler(cfg Config, subscriptions *subscriptionCache) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Method, http.MethodPost) {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !auth(r) {
+			writeUnauthorized(w)
+			return
+		}
+
+		pubkey := r.URL.Query().Get("pubkey")
+		if pubkey == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("must provide pubkey param"))
+			return
+		}
+
+		subscriptions.invalidate(pubkey)
+		log.Printf("invalidated cached subscription: %s\n", pubkey)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func adminOutboxHandler(cfg Config, o *outbox) func(http.ResponseWriter, *http.Request) {
+	const template = "outbox.html"
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			writeUnauthorized(w)
+			return
+		}
+
+		if o == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("outbox not enabled"))
+			return
+		}
+
+		var (
+			status   = r.URL.Query().Get("status")
+			limitStr = r.URL.Query().Get("limit")
+		)
+
 		limit := 100
 		if limitStr != "" {
 			if i, err := strconv.Atoi(limitStr); err == nil {
@@ -47,7 +367,7 @@ func adminHandler(cfg Config, db relayer.Storage) func(http.ResponseWriter, *htt
 			}
 		}
 
-		events, err := getEvents(db, id, pk, kind, limit)
+		entries, err := o.list(status, limit)
 		if err != nil {
 			log.Println(err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -55,142 +375,394 @@ func adminHandler(cfg Config, db relayer.Storage) func(http.ResponseWriter, *htt
 			return
 		}
 
-		t, ok := templates[template]
-		if !ok {
-			log.Printf("template %s not found", template)
+		renderTemplate(w, r, template, map[string]any{
+			"entries": entries,
+		})
+	}
+}
+
+// adminOutboxRetryHandler makes the outbox entry in the id query param due
+// right away.
+func adminOutboxRetryHandler(cfg Config, o *outbox) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Method, http.MethodPost) {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !auth(r) {
+			writeUnauthorized(w)
+			return
+		}
+
+		if o == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("outbox not enabled"))
+			return
+		}
+
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("must provide id param"))
+			return
+		}
+
+		if err := o.retry(id); err != nil {
+			log.Printf("[error] retry outbox %d: %v\n", id, err)
 			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("missing template"))
+			w.Write([]byte(err.Error()))
 			return
 		}
+		log.Printf("retrying outbox entry: %d\n", id)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
 
-		tkn := make([]byte, 16)
-		rand.Read(tkn)
-		nonce := fmt.Sprintf("%x", tkn)
-		csp := fmt.Sprintf("script-src: 'self' 'unsafe-inline' 'nonce-%s'", nonce)
+func adminAccessHandler(cfg Config, a *accessList) func(http.ResponseWriter, *http.Request) {
+	const template = "access.html"
 
-		data := map[string]any{
-			"events": events,
-			"nonce":  nonce,
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			writeUnauthorized(w)
+			return
 		}
 
-		w.Header().Set("Content-Type", "text/html")
-		w.Header().Set("Content-Security-Policy", csp)
-		if err := t.Execute(w, data); err != nil {
+		var (
+			list     = r.URL.Query().Get("list")
+			limitStr = r.URL.Query().Get("limit")
+		)
+
+		limit := 100
+		if limitStr != "" {
+			if i, err := strconv.Atoi(limitStr); err == nil {
+				limit = i
+			}
+		}
+
+		entries, err := a.list(list, limit)
+		if err != nil {
 			log.Println(err)
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
+			return
 		}
+
+		renderTemplate(w, r, template, map[string]any{
+			"entries": entries,
+			"now":     time.Now(),
+		})
 	}
 }
 
-func adminDeleteHandler(cfg Config, db relayer.Storage) func(http.ResponseWriter, *http.Request) {
+// adminAccessAddHandler adds a block or allow list entry from the list,
+// type, value, reason and expires_in params. Blocking a pubkey with
+// delete_events=true also deletes all of its events.
+func adminAccessAddHandler(cfg Config, s *storage) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if !strings.EqualFold(r.Method, http.MethodDelete) {
+		if !strings.EqualFold(r.Method, http.MethodPost) {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
 
-		if !auth(r, cfg.Admins) {
-			w.Header().Add("WWW-Authenticate", `Basic realm="username and password required"`)
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("Unauthorized"))
+		if !auth(r) {
+			writeUnauthorized(w)
 			return
 		}
 
-		var (
-			id = r.URL.Query().Get("id")
-		)
-
-		filter := nostr.Filter{}
-		if id != "" {
-			filter.IDs = []string{id}
+		entry := accessEntry{
+			List:   r.FormValue("list"),
+			Type:   r.FormValue("type"),
+			Value:  r.FormValue("value"),
+			Reason: r.FormValue("reason"),
+		}
+		if expiresIn := r.FormValue("expires_in"); expiresIn != "" {
+			d, err := time.ParseDuration(expiresIn)
+			if err != nil || d <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("invalid expires_in param"))
+				return
+			}
+			expiresAt := time.Now().Add(d)
+			entry.ExpiresAt = &expiresAt
 		}
 
-		if len(filter.IDs) == 0 {
+		entry, err := normalizeAccessEntry(entry)
+		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("must provide id param"))
+			w.Write([]byte(err.Error()))
 			return
 		}
 
-		ctx := context.Background()
-		events, err := db.QueryEvents(ctx, &filter)
+		entry, err = s.access.add(entry)
 		if err != nil {
-			fmt.Printf("[error] query events: %v", err)
+			log.Printf("[error] add access list entry: %v\n", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
 			return
 		}
+		log.Printf("added access list entry: %d %s %s %s\n", entry.ID, entry.List, entry.Type, entry.Value)
 
-		for event := range events {
-			if err := db.DeleteEvent(ctx, event.ID, event.PubKey); err != nil {
-				log.Printf("[error] DeleteEvent %s: %s\n", event.ID, err)
-			} else {
-				log.Printf("deleted event: %s\n", event.String())
+		var deleted int
+		if r.FormValue("delete_events") == "true" && entry.List == accessListBlock && entry.Type == accessTypePubkey {
+			deleted, err = s.deleteEventsByPubkey(adminContext(r.Context()), entry.Value, adminName(r))
+			if err != nil {
+				log.Printf("[error] delete events of %s: %v\n", entry.Value, err)
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(err.Error()))
+				return
 			}
+			log.Printf("deleted %d events of blocked pubkey: %s\n", deleted, entry.Value)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]any{
+			"entry":          entry,
+			"deleted_events": deleted,
+		}); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// adminAccessRemoveHandler removes the access list entry in the id query
+// param.
+func adminAccessRemoveHandler(cfg Config, a *accessList) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Method, http.MethodPost) {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
 		}
 
+		if !auth(r) {
+			writeUnauthorized(w)
+			return
+		}
+
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("must provide id param"))
+			return
+		}
+
+		if err := a.remove(id); err != nil {
+			log.Printf("[error] remove access list entry %d: %v\n", id, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		log.Printf("removed access list entry: %d\n", id)
+
 		w.WriteHeader(http.StatusNoContent)
-		w.Write([]byte(""))
-		return
 	}
 }
 
-func auth(r *http.Request, admins map[string]string) bool {
-	user, pass, ok := r.BasicAuth()
-	if !ok {
-		fmt.Println("Error parsing basic auth")
-		return false
+func writeUnauthorized(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte("Unauthorized"))
+}
+
+// adminLoginHandler shows the login form and signs admins in with a session
+// cookie, recording every attempt in the audit log.
+func adminLoginHandler(cfg Config, a *adminAuth, audit *auditLog) func(http.ResponseWriter, *http.Request) {
+	const template = "login.html"
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		next := safeRedirect(r.FormValue("next"))
+
+		switch r.Method {
+		case http.MethodGet:
+			if _, ok := a.session(r); ok {
+				http.Redirect(w, r, next, http.StatusSeeOther)
+				return
+			}
+			renderTemplate(w, r, template, map[string]any{
+				"next": next,
+			})
+			return
+		case http.MethodPost:
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		user := r.PostFormValue("username")
+		ip := clientIP(r, cfg.RateLimits.TrustForwardedFor)
+
+		// Logging in has no session to take a CSRF token from, so another
+		// site could otherwise sign the browser in to an account of its
+		// choosing.
+		if !sameOrigin(r) {
+			log.Printf("cross-origin login for admin %q from %s\n", user, ip)
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("invalid origin"))
+			return
+		}
+		ok, locked := a.login(user, r.PostFormValue("password"), ip)
+
+		action, status, message := "login", http.StatusSeeOther, ""
+		switch {
+		case locked:
+			action, status, message = "login_locked", http.StatusTooManyRequests, "too many failed logins, try again later"
+		case !ok:
+			action, status, message = "login_failed", http.StatusUnauthorized, "invalid username or password"
+		}
+
+		if audit != nil {
+			// Only the username is recorded, never the submitted password
+			entry := auditEntry{Admin: user, Action: action, Target: user, Params: json.RawMessage("{}"), Status: status, IP: ip}
+			if err := audit.record(context.Background(), entry); err != nil {
+				log.Printf("[error] audit %s by %s: %v\n", action, user, err)
+			}
+		}
+
+		if message != "" {
+			log.Printf("%s for admin %q from %s\n", action, user, ip)
+			renderTemplate(w, r, template, map[string]any{
+				"next":  next,
+				"error": message,
+			})
+			return
+		}
+
+		session, err := a.newSession(user)
+		if err != nil {
+			log.Printf("[error] new admin session: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		a.setSessionCookie(w, r, session)
+		log.Printf("admin %s logged in from %s\n", user, ip)
+
+		http.Redirect(w, r, next, http.StatusSeeOther)
 	}
+}
 
-	adminPass, ok := admins[user]
-	if !ok {
-		fmt.Printf("invalid user: %s\n", user)
-		return false
+// adminLogoutHandler clears the session cookie. Sessions are stateless, so
+// a copied cookie stays valid until it expires, the admin's password
+// changes or the session secret is rotated.
+func adminLogoutHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Method, http.MethodPost) {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth(r) {
+			writeUnauthorized(w)
+			return
+		}
+
+		clearSessionCookie(w, r)
+		w.WriteHeader(http.StatusNoContent)
 	}
+}
+
+// adminAuditHandler shows the audit log filtered by the admin, action,
+// target, since, until and limit params. With format=jsonl the matching
+// entries are downloaded as JSON lines.
+func adminAuditHandler(cfg Config, a *auditLog) func(http.ResponseWriter, *http.Request) {
+	const template = "audit.html"
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !auth(r) {
+			writeUnauthorized(w)
+			return
+		}
 
-	if !strings.EqualFold(pass, adminPass) {
-		fmt.Printf("invalid password for user: %s\n", user)
-		return false
+		export := r.URL.Query().Get("format") == "jsonl"
+		limit := defaultAuditListLimit
+		if export {
+			limit = defaultAuditExportLimit
+		}
+
+		q, err := parseAuditQuery(r.URL.Query(), limit)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		entries, err := a.list(r.Context(), q)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		if !export {
+			renderTemplate(w, r, template, map[string]any{
+				"entries": entries,
+			})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="audit-%d.jsonl"`, time.Now().Unix()))
+		enc := json.NewEncoder(w)
+		for _, entry := range entries {
+			if err := enc.Encode(entry); err != nil {
+				log.Println(err)
+				return
+			}
+		}
 	}
+}
+
+// adminName returns the name of the admin making r, for recording who made
+// a change.
+func adminName(r *http.Request) string {
+	session, _ := sessionFromContext(r.Context())
+	return session.user
+}
 
-	return true
+// auth reports whether r was made by a signed in admin. Admin routes are
+// wrapped in adminAuth.protect, which sets the session.
+func auth(r *http.Request) bool {
+	_, ok := sessionFromContext(r.Context())
+	return ok
 }
 
 type uiEvent struct {
 	nostr.Event
 	PrettyTime string
 	Npub       string
+	// Moderation is the event's latest moderation change, if any.
+	Moderation *moderationEntry
 }
 
-func getEvents(db relayer.Storage, id, pk string, kind *int, limit int) ([]uiEvent, error) {
-	filter := nostr.Filter{
-		Limit: limit,
-	}
-	if id != "" {
-		filter.IDs = []string{id}
-	}
-	if pk != "" {
-		filter.Authors = []string{pk}
-	}
-	if kind != nil {
-		filter.Kinds = []int{*kind}
+func getEvents(s *storage, filter nostr.Filter) ([]uiEvent, error) {
+	ctx := context.Background()
+	events, err := selectEvents(ctx, s, filter)
+	if err != nil {
+		return nil, err
 	}
 
-	ctx := context.Background()
-	events, err := db.QueryEvents(ctx, &filter)
+	ids := make([]string, len(events))
+	for i, event := range events {
+		ids[i] = event.ID
+	}
+	moderated, err := s.moderation.entries(ctx, ids)
 	if err != nil {
-		return nil, fmt.Errorf("query events: %w", err)
+		return nil, err
 	}
 
 	var out []uiEvent
-	for event := range events {
+	for _, event := range events {
 		npub, _ := nip19.EncodePublicKey(event.PubKey)
 
-		out = append(out, uiEvent{
+		e := uiEvent{
 			Event:      *event,
 			PrettyTime: event.CreatedAt.Time().Format(time.RFC822),
 			Npub:       npub,
-		})
+		}
+		if m, ok := moderated[event.ID]; ok {
+			e.Moderation = &m
+		}
+		out = append(out, e)
 	}
 
 	return out, nil
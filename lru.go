@@ -0,0 +1,69 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lruSet is a fixed size set of strings that evicts the least recently used
+// entry when full.
+type lruSet struct {
+	mu       sync.Mutex
+	size     int
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+func newLRUSet(size int) *lruSet {
+	return &lruSet{
+		size:     size,
+		order:    list.New(),
+		elements: make(map[string]*list.Element, size),
+	}
+}
+
+func (s *lruSet) contains(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.elements[key]
+	if ok {
+		s.order.MoveToFront(e)
+	}
+
+	return ok
+}
+
+func (s *lruSet) add(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.elements[key]; ok {
+		s.order.MoveToFront(e)
+		return
+	}
+
+	s.elements[key] = s.order.PushFront(key)
+	if s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.elements, oldest.Value.(string))
+	}
+}
+
+func (s *lruSet) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.elements[key]; ok {
+		s.order.Remove(e)
+		delete(s.elements, key)
+	}
+}
+
+func (s *lruSet) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.order.Len()
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 
@@ -12,8 +14,24 @@ func main() {
 	log.Printf("build info: commit: %v date: %v\n", commit, buildDate)
 
 	configPath := flag.String("config", "config.yml", "location of config file")
+	hashPasswordFlag := flag.Bool("hash-password", false, "read a password from stdin, print its bcrypt hash for the admins config and exit")
 	flag.Parse()
 
+	if *hashPasswordFlag {
+		scanner := bufio.NewScanner(os.Stdin)
+		if !scanner.Scan() || scanner.Text() == "" {
+			log.Println("no password on stdin")
+			os.Exit(1)
+		}
+		hash, err := hashPassword(scanner.Text())
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(hash)
+		return
+	}
+
 	var cfg Config
 	log.Printf("loading config from file %q\n", *configPath)
 	if err := cfg.Load(*configPath); err != nil {
@@ -22,6 +40,12 @@ func main() {
 	}
 	log.Printf("%#v\n", cfg)
 
+	adminAuth, err := newAdminAuth(cfg)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
 	subscriptionsDB, err := sqlx.Connect("postgres", cfg.SubscriptionsDBURL)
 	if err != nil {
 		log.Println(err)
@@ -34,8 +58,24 @@ func main() {
 		os.Exit(1)
 	}
 
-	relay.server.Router().HandleFunc("/admin", adminHandler(cfg, relay.storage))
-	relay.server.Router().HandleFunc("/admin/delete", adminDeleteHandler(cfg, relay.storage))
+	audit := relay.storage.audit
+	router := relay.server.Router()
+	protect := adminAuth.protect
+	router.HandleFunc("/admin/login", adminLoginHandler(cfg, adminAuth, audit))
+	router.HandleFunc("/admin/logout", protect(audited(cfg, audit, "logout", "", adminLogoutHandler())))
+	router.HandleFunc("/admin", protect(adminHandler(cfg, relay.storage)))
+	router.HandleFunc("/admin/delete", protect(audited(cfg, audit, "delete_event", "id", adminDeleteHandler(cfg, relay.storage))))
+	router.HandleFunc("/admin/bulk", protect(audited(cfg, audit, "bulk", "pubkey", adminBulkHandler(cfg, relay.storage))))
+	router.HandleFunc("/admin/moderation", protect(audited(cfg, audit, "moderate_event", "id", adminModerationHandler(cfg, relay.storage.moderation))))
+	router.HandleFunc("/admin/stats", protect(adminStatsHandler(cfg, relay)))
+	router.HandleFunc("/admin/subscriptions/invalidate", protect(audited(cfg, audit, "invalidate_subscription", "pubkey", adminInvalidateSubscriptionHandler(cfg, relay.subscriptions))))
+	router.HandleFunc("/admin/ratelimits", protect(adminRateLimitsHandler(cfg, relay.limits)))
+	router.HandleFunc("/admin/outbox", protect(adminOutboxHandler(cfg, relay.storage.outbox)))
+	router.HandleFunc("/admin/outbox/retry", protect(audited(cfg, audit, "retry_outbox", "id", adminOutboxRetryHandler(cfg, relay.storage.outbox))))
+	router.HandleFunc("/admin/access", protect(adminAccessHandler(cfg, relay.storage.access)))
+	router.HandleFunc("/admin/access/add", protect(audited(cfg, audit, "add_access_entry", "value", adminAccessAddHandler(cfg, relay.storage))))
+	router.HandleFunc("/admin/access/remove", protect(audited(cfg, audit, "remove_access_entry", "id", adminAccessRemoveHandler(cfg, relay.storage.access))))
+	router.HandleFunc("/admin/audit", protect(adminAuditHandler(cfg, audit)))
 
 	if err := relay.Start(); err != nil {
 		log.Printf("relay err: %v\n", err)
@@ -0,0 +1,22 @@
+-- Notify the relay whenever a subscription is bought or changes so it can
+-- refresh its cached entitlement for the pubkey without waiting for it to expire.
+-- Apply to the subscriptions database.
+
+CREATE OR REPLACE FUNCTION notify_subscription_changed() RETURNS trigger AS $$
+BEGIN
+  PERFORM pg_notify(
+    'subscription_changed',
+    json_build_object(
+      'pubkey', NEW.pubkey,
+      'expires_at', extract(epoch FROM NEW.expires_at)::bigint
+    )::text
+  );
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS subscription_changed ON subscription;
+
+CREATE TRIGGER subscription_changed
+  AFTER INSERT OR UPDATE ON subscription
+  FOR EACH ROW EXECUTE FUNCTION notify_subscription_changed();
@@ -0,0 +1,19 @@
+-- Subscriptions carry a tier that the relay maps to the kinds it may
+-- publish (see subscription_tiers in the relay config). Apply to the
+-- subscriptions database.
+
+ALTER TABLE subscription ADD COLUMN IF NOT EXISTS tier text NOT NULL DEFAULT 'paid';
+
+CREATE OR REPLACE FUNCTION notify_subscription_changed() RETURNS trigger AS $$
+BEGIN
+  PERFORM pg_notify(
+    'subscription_changed',
+    json_build_object(
+      'pubkey', NEW.pubkey,
+      'tier', NEW.tier,
+      'expires_at', extract(epoch FROM NEW.expires_at)::bigint
+    )::text
+  );
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
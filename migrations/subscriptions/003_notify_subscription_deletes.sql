@@ -0,0 +1,32 @@
+-- Notify the relay when a subscription row is deleted too, e.g. on a refund,
+-- with the deleted row's pubkey, so the pubkey's cached entitlement isn't kept
+-- until it expires. Apply to the subscriptions database.
+
+CREATE OR REPLACE FUNCTION notify_subscription_changed() RETURNS trigger AS $$
+DECLARE
+  changed subscription%ROWTYPE;
+BEGIN
+  IF TG_OP = 'DELETE' THEN
+    changed := OLD;
+  ELSE
+    changed := NEW;
+  END IF;
+
+  PERFORM pg_notify(
+    'subscription_changed',
+    json_build_object(
+      'op', TG_OP,
+      'pubkey', changed.pubkey,
+      'tier', changed.tier,
+      'expires_at', extract(epoch FROM changed.expires_at)::bigint
+    )::text
+  );
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS subscription_changed ON subscription;
+
+CREATE TRIGGER subscription_changed
+  AFTER INSERT OR UPDATE OR DELETE ON subscription
+  FOR EACH ROW EXECUTE FUNCTION notify_subscription_changed();
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/relayer/v2"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Moderation states. Only visible events are served to clients; admins see
+// them all.
+const (
+	moderationVisible = "visible"
+	moderationHidden  = "hidden"
+	// moderationQuarantined events are held for review. Their author can
+	// still read them over an authenticated connection.
+	moderationQuarantined = "quarantined"
+	// moderationDeleted events are soft-deleted and can be restored.
+	moderationDeleted = "deleted"
+
+	// moderationRefreshInterval is how often states are reloaded, picking
+	// up changes made through other relay instances.
+	moderationRefreshInterval = time.Minute
+
+	bulkActionDelete     = "delete"
+	bulkActionHide       = "hide"
+	bulkActionQuarantine = "quarantine"
+	bulkActionRestore    = "restore"
+	bulkActionExport     = "export"
+
+	// adminTimeLayout is the format of datetime-local inputs, read as UTC.
+	adminTimeLayout = "2006-01-02T15:04"
+
+	// bulkPageSize is how many events bulk actions fetch at a time, the
+	// most the storage returns for one query.
+	bulkPageSize = 1000
+	// bulkMaxEvents is the most events one bulk action may select.
+	bulkMaxEvents = 50000
+)
+
+// bulkActionStates are the moderation states bulk actions set.
+var bulkActionStates = map[string]string{
+	bulkActionDelete:     moderationDeleted,
+	bulkActionHide:       moderationHidden,
+	bulkActionQuarantine: moderationQuarantined,
+	bulkActionRestore:    moderationVisible,
+}
+
+// moderationEntry is the latest moderation change of an event.
+type moderationEntry struct {
+	EventID   string    `db:"event_id"`
+	State     string    `db:"state"`
+	ChangedBy string    `db:"changed_by"`
+	ChangedAt time.Time `db:"updated_at"`
+}
+
+func validModerationState(state string) bool {
+	switch state {
+	case moderationVisible, moderationHidden, moderationQuarantined, moderationDeleted:
+		return true
+	}
+	return false
+}
+
+// moderation holds the moderation state of events, keeping those that
+// aren't visible in memory. Events without a state are visible.
+type moderation struct {
+	db *sqlx.DB
+
+	mu     sync.RWMutex
+	states map[string]string
+}
+
+func newModeration(db *sqlx.DB) (*moderation, error) {
+	_, err := db.Exec(`
+CREATE TABLE IF NOT EXISTS event_moderation (
+  event_id text PRIMARY KEY,
+  state text NOT NULL,
+  updated_at timestamptz NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE event_moderation ADD COLUMN IF NOT EXISTS changed_by text NOT NULL DEFAULT '';
+`)
+	if err != nil {
+		return nil, fmt.Errorf("create table: %w", err)
+	}
+
+	m := &moderation{db: db}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// load replaces the in-memory states with those in the database.
+func (m *moderation) load() error {
+	rows, err := m.db.Query("SELECT event_id, state FROM event_moderation WHERE state <> $1", moderationVisible)
+	if err != nil {
+		return fmt.Errorf("select moderation: %w", err)
+	}
+	defer rows.Close()
+
+	states := make(map[string]string)
+	for rows.Next() {
+		var id, state string
+		if err := rows.Scan(&id, &state); err != nil {
+			return fmt.Errorf("scan moderation: %w", err)
+		}
+		states[id] = state
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("select moderation: %w", err)
+	}
+
+	m.mu.Lock()
+	m.states = states
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *moderation) refresh() {
+	for range time.Tick(moderationRefreshInterval) {
+		if err := m.load(); err != nil {
+			log.Printf("[error] refresh moderation: %v\n", err)
+		}
+	}
+}
+
+// state returns the moderation state of the event with id, empty if it is
+// visible. It is safe to call on a nil *moderation.
+func (m *moderation) state(id string) string {
+	if m == nil {
+		return ""
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.states[id]
+}
+
+// setState sets the moderation state of the events with ids, recording
+// the admin who changed it. Setting it to visible restores them.
+func (m *moderation) setState(ctx context.Context, ids []string, state, changedBy string) error {
+	if !validModerationState(state) {
+		return fmt.Errorf("invalid moderation state %q", state)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	_, err := m.db.ExecContext(ctx, `INSERT INTO event_moderation (event_id, state, changed_by)
+SELECT unnest($1::text[]), $2, $3
+ON CONFLICT (event_id) DO UPDATE SET state = EXCLUDED.state, changed_by = EXCLUDED.changed_by, updated_at = NOW()`, pq.Array(ids), state, changedBy)
+	if err != nil {
+		return fmt.Errorf("upsert moderation: %w", err)
+	}
+
+	m.mu.Lock()
+	for _, id := range ids {
+		if state == moderationVisible {
+			delete(m.states, id)
+		} else {
+			m.states[id] = state
+		}
+	}
+	m.mu.Unlock()
+
+	return nil
+}
+
+// entries returns the latest moderation change of each of ids that has
+// one, including restored events.
+func (m *moderation) entries(ctx context.Context, ids []string) (map[string]moderationEntry, error) {
+	var entries []moderationEntry
+	err := m.db.SelectContext(ctx, &entries, `SELECT event_id, state, changed_by, updated_at
+FROM event_moderation
+WHERE event_id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return nil, fmt.Errorf("select moderation: %w", err)
+	}
+
+	byID := make(map[string]moderationEntry, len(entries))
+	for _, e := range entries {
+		byID[e.EventID] = e
+	}
+
+	return byID, nil
+}
+
+// conditions is the SQL condition, for PostgresBackend.Conditions, that
+// hides events that aren't visible from everyone but admins and the
+// authenticated author of a quarantined event. Filtering in the query keeps
+// limits and counts right.
+func (m *moderation) conditions(ctx context.Context) (string, []any) {
+	if isAdminContext(ctx) {
+		return "", nil
+	}
+
+	if pubkey, ok := authedPubkey(ctx); ok {
+		return `NOT EXISTS (SELECT 1 FROM event_moderation
+WHERE event_moderation.event_id = event.id AND event_moderation.state <> ?
+	AND NOT (event_moderation.state = ? AND event.pubkey = ?))`, []any{moderationVisible, moderationQuarantined, pubkey}
+	}
+
+	return `NOT EXISTS (SELECT 1 FROM event_moderation
+WHERE event_moderation.event_id = event.id AND event_moderation.state <> ?)`, []any{moderationVisible}
+}
+
+// adminFilter builds the filter the admin UI selects events with from the
+// id, kind, pubkey, limit, since, until and tag params. Tags are searched
+// as name:value, e.g. t:music.
+func adminFilter(q url.Values) (nostr.Filter, error) {
+	filter := nostr.Filter{Limit: 100}
+
+	if id := q.Get("id"); id != "" {
+		filter.IDs = []string{id}
+	}
+	if pk := q.Get("pubkey"); pk != "" {
+		filter.Authors = []string{pk}
+	}
+	if kindStr := q.Get("kind"); kindStr != "" {
+		kind, err := strconv.Atoi(kindStr)
+		if err != nil {
+			return filter, fmt.Errorf("invalid kind %q", kindStr)
+		}
+		filter.Kinds = []int{kind}
+	}
+	if limitStr := q.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 {
+			return filter, fmt.Errorf("invalid limit %q", limitStr)
+		}
+		filter.Limit = limit
+	}
+	if sinceStr := q.Get("since"); sinceStr != "" {
+		since, err := parseAdminTime(sinceStr)
+		if err != nil {
+			return filter, fmt.Errorf("invalid since %q", sinceStr)
+		}
+		filter.Since = &since
+	}
+	if untilStr := q.Get("until"); untilStr != "" {
+		until, err := parseAdminTime(untilStr)
+		if err != nil {
+			return filter, fmt.Errorf("invalid until %q", untilStr)
+		}
+		filter.Until = &until
+	}
+	if tag := q.Get("tag"); tag != "" {
+		name, value, ok := strings.Cut(tag, ":")
+		if !ok || name == "" || value == "" {
+			return filter, fmt.Errorf("invalid tag %q, must be name:value", tag)
+		}
+		filter.Tags = nostr.TagMap{name: {value}}
+	}
+
+	return filter, nil
+}
+
+// parseAdminTime reads unix seconds or a datetime-local value.
+func parseAdminTime(s string) (nostr.Timestamp, error) {
+	if unix, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return nostr.Timestamp(unix), nil
+	}
+
+	t, err := time.Parse(adminTimeLayout, s)
+	if err != nil {
+		return 0, err
+	}
+
+	return nostr.Timestamp(t.Unix()), nil
+}
+
+// narrows reports whether filter selects anything less than every event,
+// which bulk actions require.
+func narrows(filter nostr.Filter) bool {
+	return len(filter.IDs) > 0 || len(filter.Authors) > 0 || len(filter.Kinds) > 0 ||
+		len(filter.Tags) > 0 || filter.Since != nil || filter.Until != nil
+}
+
+// selectEvents returns the events matching filter as an admin sees them.
+// The storage only matches tag values, so tag names are checked here.
+func selectEvents(ctx context.Context, db relayer.Storage, filter nostr.Filter) ([]*nostr.Event, error) {
+	events, err := db.QueryEvents(adminContext(ctx), &filter)
+	if err != nil {
+		return nil, fmt.Errorf("query events: %w", err)
+	}
+
+	var out []*nostr.Event
+	for event := range events {
+		if filter.Matches(event) {
+			out = append(out, event)
+		}
+	}
+
+	return out, nil
+}
+
+// selectAllEvents is selectEvents ignoring filter's limit, paging back
+// through created_at until every matching event is found. It fails rather
+// than return a partial selection, if more than max events match or a
+// single second holds more than a page of events.
+func selectAllEvents(ctx context.Context, db relayer.Storage, filter nostr.Filter, max int) ([]*nostr.Event, error) {
+	filter.Limit = bulkPageSize
+
+	seen := make(map[string]bool)
+	var out []*nostr.Event
+	for {
+		events, err := db.QueryEvents(adminContext(ctx), &filter)
+		if err != nil {
+			return nil, fmt.Errorf("query events: %w", err)
+		}
+
+		var (
+			fetched, added int
+			oldest         nostr.Timestamp
+		)
+		for event := range events {
+			fetched++
+			if fetched == 1 || event.CreatedAt < oldest {
+				oldest = event.CreatedAt
+			}
+			if seen[event.ID] {
+				continue
+			}
+			seen[event.ID] = true
+			added++
+			if filter.Matches(event) {
+				out = append(out, event)
+			}
+		}
+
+		if len(out) > max {
+			return nil, fmt.Errorf("more than %d events match, narrow the search", max)
+		}
+		if fetched < bulkPageSize {
+			return out, nil
+		}
+		if added == 0 {
+			return nil, fmt.Errorf("more than %d events were created at %d, narrow the search", bulkPageSize, oldest)
+		}
+
+		// The next page starts at the oldest second seen, as more events
+		// may share it. Those already seen are skipped.
+		until := oldest
+		filter.Until = &until
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminFilter(t *testing.T) {
+	ts := func(unix int64) *nostr.Timestamp {
+		t := nostr.Timestamp(unix)
+		return &t
+	}
+
+	var tests = []struct {
+		name        string
+		query       string
+		expected    nostr.Filter
+		expectedErr bool
+	}{
+		{
+			name:     "nothing",
+			query:    "",
+			expected: nostr.Filter{Limit: 100},
+		},
+		{
+			name:  "all params",
+			query: "id=abc&kind=1808&pubkey=def&limit=10&since=1690000000&until=2023-07-23T12:00&tag=t:music",
+			expected: nostr.Filter{
+				IDs:     []string{"abc"},
+				Kinds:   []int{1808},
+				Authors: []string{"def"},
+				Limit:   10,
+				Since:   ts(1690000000),
+				Until:   ts(1690113600),
+				Tags:    nostr.TagMap{"t": {"music"}},
+			},
+		},
+		{
+			name:        "invalid kind",
+			query:       "kind=track",
+			expectedErr: true,
+		},
+		{
+			name:        "invalid limit",
+			query:       "limit=0",
+			expectedErr: true,
+		},
+		{
+			name:        "invalid since",
+			query:       "since=yesterday",
+			expectedErr: true,
+		},
+		{
+			name:        "tag without value",
+			query:       "tag=t",
+			expectedErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := url.ParseQuery(tt.query)
+			assert.NoError(t, err)
+
+			filter, err := adminFilter(q)
+			if tt.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, filter)
+		})
+	}
+}
+
+func TestNarrows(t *testing.T) {
+	since := nostr.Timestamp(1690000000)
+
+	assert.False(t, narrows(nostr.Filter{Limit: 100}))
+	assert.True(t, narrows(nostr.Filter{Kinds: []int{1}}))
+	assert.True(t, narrows(nostr.Filter{Since: &since}))
+	assert.True(t, narrows(nostr.Filter{Tags: nostr.TagMap{"t": {"music"}}}))
+}
+
+// pagedStorage serves events newest first, at most limit at a time and
+// matching only kinds and until, like the Postgres backend.
+type pagedStorage struct {
+	events  []*nostr.Event
+	queries int
+}
+
+func (s *pagedStorage) Init() error                                       { return nil }
+func (s *pagedStorage) DeleteEvent(context.Context, string, string) error { return nil }
+func (s *pagedStorage) SaveEvent(context.Context, *nostr.Event) error     { return nil }
+func (s *pagedStorage) QueryEvents(ctx context.Context, filter *nostr.Filter) (chan *nostr.Event, error) {
+	s.queries++
+	sort.SliceStable(s.events, func(i, j int) bool {
+		return s.events[i].CreatedAt > s.events[j].CreatedAt
+	})
+
+	events := make(chan *nostr.Event, filter.Limit)
+	for _, event := range s.events {
+		if len(events) == filter.Limit {
+			break
+		}
+		if filter.Until != nil && event.CreatedAt > *filter.Until {
+			continue
+		}
+		events <- event
+	}
+	close(events)
+
+	return events, nil
+}
+
+func TestSelectAllEvents(t *testing.T) {
+	db := &pagedStorage{}
+	for i := 0; i < 2500; i++ {
+		tag := "music"
+		if i%2 == 0 {
+			tag = "other"
+		}
+		db.events = append(db.events, &nostr.Event{
+			ID: fmt.Sprintf("%d", i),
+			// Ten events per second, so pages end mid second
+			CreatedAt: nostr.Timestamp(1690000000 + i/10),
+			Tags:      nostr.Tags{{"t", tag}},
+		})
+	}
+
+	// Tag names are only checked after fetching, so every page counts
+	events, err := selectAllEvents(context.Background(), db, nostr.Filter{Tags: nostr.TagMap{"t": {"music"}}, Limit: 100}, bulkMaxEvents)
+	assert.NoError(t, err)
+	assert.Len(t, events, 1250)
+	assert.Equal(t, 3, db.queries)
+
+	ids := make(map[string]bool)
+	for _, event := range events {
+		ids[event.ID] = true
+	}
+	assert.Len(t, ids, 1250)
+
+	_, err = selectAllEvents(context.Background(), db, nostr.Filter{}, 2000)
+	assert.Error(t, err, "too many events")
+
+	// A page of events from the same second can't be paged past
+	for _, event := range db.events {
+		event.CreatedAt = 1690000000
+	}
+	_, err = selectAllEvents(context.Background(), db, nostr.Filter{}, bulkMaxEvents)
+	assert.Error(t, err)
+}
+
+func TestModerationConditions(t *testing.T) {
+	const authorPubkey = "e6230af84359c4bedd38207a349dfbf8d25ad3b767518e7231fcae03907b9282"
+
+	m := &moderation{states: map[string]string{"hidden": moderationHidden}}
+
+	condition, params := m.conditions(context.Background())
+	assert.Contains(t, condition, "NOT EXISTS (SELECT 1 FROM event_moderation")
+	assert.NotContains(t, condition, "event.pubkey")
+	assert.Equal(t, []any{moderationVisible}, params)
+
+	// The authenticated author still sees their quarantined events
+	condition, params = m.conditions(authedContext(authorPubkey))
+	assert.Contains(t, condition, "event.pubkey = ?")
+	assert.Equal(t, []any{moderationVisible, moderationQuarantined, authorPubkey}, params)
+	assert.Equal(t, strings.Count(condition, "?"), len(params))
+
+	condition, params = m.conditions(adminContext(authedContext(authorPubkey)))
+	assert.Empty(t, condition)
+	assert.Empty(t, params)
+
+	assert.Equal(t, moderationHidden, m.state("hidden"))
+	assert.Equal(t, "", m.state("visible"))
+
+	var nilModeration *moderation
+	assert.Equal(t, "", nilModeration.state("hidden"))
+}
+
+func TestModerationSetStateInvalid(t *testing.T) {
+	m := &moderation{states: map[string]string{}}
+	assert.Error(t, m.setState(context.Background(), []string{"abc"}, "gone", "admin"))
+}
+
+func TestReferencesKnownEventModerated(t *testing.T) {
+	f := newSeenFilter(1000, 0.01)
+	f.Add([]byte("visible"))
+	f.Add([]byte("deleted"))
+	s := &storage{
+		seenEvents: f,
+		moderation: &moderation{states: map[string]string{"deleted": moderationDeleted}},
+	}
+
+	assert.True(t, s.referencesKnownEvent(&nostr.Event{Tags: nostr.Tags{{"e", "visible"}}}))
+	assert.False(t, s.referencesKnownEvent(&nostr.Event{Tags: nostr.Tags{{"e", "deleted"}}}))
+}
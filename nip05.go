@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultNip05CacheTTL         = time.Hour
+	defaultNip05NegativeCacheTTL = 10 * time.Minute
+	defaultNip05Timeout          = 5 * time.Second
+	defaultNip05MaxFetches       = 8
+
+	// nip05MaxBodySize is the most of a nostr.json response that is read.
+	nip05MaxBodySize = 64 << 10
+)
+
+// httpDoer sends HTTP requests. *http.Client is one.
+type httpDoer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// nip05Verifier checks whether a pubkey has a valid NIP-05 identifier on
+// one of the allowed domains, caching the results. Identifiers are fetched
+// in the background, so checking one never waits on the domain.
+type nip05Verifier struct {
+	domains map[string]bool
+	// identifier returns the nip05 field of the pubkey's latest metadata.
+	identifier  func(pubkey string) (string, error)
+	client      httpDoer
+	timeout     time.Duration
+	ttl         time.Duration
+	negativeTTL time.Duration
+	// maxFetches caps the fetches in flight at once.
+	maxFetches int
+	now        func() time.Time
+
+	mu       sync.Mutex
+	entries  map[string]nip05Entry
+	inflight map[string]bool
+	// pending tracks the running fetches, so tests can wait for them.
+	pending sync.WaitGroup
+}
+
+type nip05Entry struct {
+	verified  bool
+	expiresAt time.Time
+}
+
+func newNip05Verifier(cfg Nip05GateConfig, identifier func(string) (string, error)) *nip05Verifier {
+	v := &nip05Verifier{
+		domains:     make(map[string]bool),
+		identifier:  identifier,
+		client:      &http.Client{CheckRedirect: noRedirects},
+		timeout:     cfg.Timeout,
+		ttl:         cfg.CacheTTL,
+		negativeTTL: cfg.NegativeCacheTTL,
+		maxFetches:  cfg.MaxConcurrentFetches,
+		now:         time.Now,
+		entries:     make(map[string]nip05Entry),
+		inflight:    make(map[string]bool),
+	}
+	for _, domain := range cfg.Domains {
+		v.domains[strings.ToLower(domain)] = true
+	}
+	if v.timeout <= 0 {
+		v.timeout = defaultNip05Timeout
+	}
+	if v.ttl <= 0 {
+		v.ttl = defaultNip05CacheTTL
+	}
+	if v.negativeTTL <= 0 {
+		v.negativeTTL = defaultNip05NegativeCacheTTL
+	}
+	if v.maxFetches <= 0 {
+		v.maxFetches = defaultNip05MaxFetches
+	}
+
+	return v
+}
+
+// NIP-05 forbids following redirects.
+func noRedirects(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// verified reports whether pubkey has a valid identifier on an allowed
+// domain. It only reads the cache: a missing or expired entry starts a
+// fetch, and until it lands pubkeys never checked count as unverified while
+// others keep their last result.
+func (v *nip05Verifier) verified(pubkey string) bool {
+	now := v.now()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	entry, ok := v.entries[pubkey]
+	if ok && now.Before(entry.expiresAt) {
+		return entry.verified
+	}
+	v.fetch(pubkey)
+
+	return ok && entry.verified
+}
+
+// refresh drops pubkey's cached result and verifies it again in the
+// background, e.g. after it saved new metadata.
+func (v *nip05Verifier) refresh(pubkey string) {
+	if v == nil {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	delete(v.entries, pubkey)
+	v.fetch(pubkey)
+}
+
+// fetch verifies pubkey in the background and caches the result, unless it
+// is already being fetched or too many fetches are in flight. Lookup
+// failures count as unverified, and are cached for the shorter negative TTL.
+// v.mu must be held.
+func (v *nip05Verifier) fetch(pubkey string) {
+	if v.inflight[pubkey] || len(v.inflight) >= v.maxFetches {
+		return
+	}
+	v.inflight[pubkey] = true
+	v.pending.Add(1)
+
+	go func() {
+		defer v.pending.Done()
+
+		verified, err := v.verify(pubkey)
+		if err != nil {
+			log.Printf("nip05 verify %s: %v\n", pubkey, err)
+		}
+
+		ttl := v.negativeTTL
+		if verified {
+			ttl = v.ttl
+		}
+		now := v.now()
+
+		v.mu.Lock()
+		defer v.mu.Unlock()
+
+		delete(v.inflight, pubkey)
+		v.entries[pubkey] = nip05Entry{verified: verified, expiresAt: now.Add(ttl)}
+		// Drop expired entries so the map doesn't grow with every author
+		// ever checked.
+		if len(v.entries) > 10000 {
+			for k, e := range v.entries {
+				if !now.Before(e.expiresAt) {
+					delete(v.entries, k)
+				}
+			}
+		}
+	}()
+}
+
+func (v *nip05Verifier) verify(pubkey string) (bool, error) {
+	identifier, err := v.identifier(pubkey)
+	if err != nil {
+		return false, err
+	}
+
+	name, domain, ok := strings.Cut(strings.ToLower(identifier), "@")
+	if !ok {
+		// A bare domain is the same as _@domain
+		name, domain = "_", name
+	}
+	if name == "" || !v.domains[domain] {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), v.timeout)
+	defer cancel()
+
+	wellKnown := fmt.Sprintf("https://%s/.well-known/nostr.json?name=%s", domain, url.QueryEscape(name))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnown, nil)
+	if err != nil {
+		return false, err
+	}
+
+	res, err := v.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("fetch %s: %w", wellKnown, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("fetch %s: %s", wellKnown, res.Status)
+	}
+
+	var body struct {
+		Names map[string]string `json:"names"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, nip05MaxBodySize)).Decode(&body); err != nil {
+		return false, fmt.Errorf("decode %s: %w", wellKnown, err)
+	}
+
+	return body.Names[name] == pubkey, nil
+}
+
+// nip05Identifier returns the nip05 field of the pubkey's latest saved
+// metadata event, or an empty string if there is none.
+func (s *storage) nip05Identifier(pubkey string) (string, error) {
+	var content string
+	err := s.DB.Get(&content, "SELECT content FROM event WHERE pubkey = $1 AND kind = 0 ORDER BY created_at DESC LIMIT 1", pubkey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("select metadata: %w", err)
+	}
+
+	var metadata struct {
+		Nip05 string `json:"nip05"`
+	}
+	if err := json.Unmarshal([]byte(content), &metadata); err != nil {
+		return "", nil
+	}
+
+	return metadata.Nip05, nil
+}
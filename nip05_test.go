@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+// localDoer sends every request to a local stand-in server, keeping the
+// path and query.
+type localDoer struct {
+	server *httptest.Server
+	hosts  []string
+}
+
+func (d *localDoer) Do(req *http.Request) (*http.Response, error) {
+	d.hosts = append(d.hosts, req.URL.Host)
+
+	u, _ := url.Parse(d.server.URL)
+	req.URL.Scheme = u.Scheme
+	req.URL.Host = u.Host
+
+	return d.server.Client().Do(req)
+}
+
+func TestNip05Verifier(t *testing.T) {
+	const (
+		artistPubkey = "e6230af84359c4bedd38207a349dfbf8d25ad3b767518e7231fcae03907b9282"
+		otherPubkey  = "82f3b82c7f855340fc1905b20ac50b95d64c700d2b9546507415088e81535425"
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/nostr.json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		switch r.URL.Query().Get("name") {
+		case "artist":
+			w.Write([]byte(`{"names": {"artist": "` + artistPubkey + `"}}`))
+		case "_":
+			w.Write([]byte(`{"names": {"_": "` + artistPubkey + `"}}`))
+		case "broken":
+			w.Write([]byte(`not json`))
+		case "oversized":
+			w.Write([]byte(`{"padding": "` + strings.Repeat("x", nip05MaxBodySize) + `", "names": {"oversized": "` + artistPubkey + `"}}`))
+		default:
+			w.Write([]byte(`{"names": {}}`))
+		}
+	}))
+	defer server.Close()
+
+	var tests = []struct {
+		name          string
+		pubkey        string
+		identifier    string
+		identifierErr error
+		expected      bool
+		expectedHosts []string
+	}{
+		{
+			name:          "verified",
+			pubkey:        artistPubkey,
+			identifier:    "artist@partner.example",
+			expected:      true,
+			expectedHosts: []string{"partner.example"},
+		},
+		{
+			name:          "verified root identifier",
+			pubkey:        artistPubkey,
+			identifier:    "partner.example",
+			expected:      true,
+			expectedHosts: []string{"partner.example"},
+		},
+		{
+			name:          "identifier of another pubkey",
+			pubkey:        otherPubkey,
+			identifier:    "artist@partner.example",
+			expected:      false,
+			expectedHosts: []string{"partner.example"},
+		},
+		{
+			name:          "unknown name",
+			pubkey:        artistPubkey,
+			identifier:    "nobody@partner.example",
+			expected:      false,
+			expectedHosts: []string{"partner.example"},
+		},
+		{
+			name:          "malformed response",
+			pubkey:        artistPubkey,
+			identifier:    "broken@partner.example",
+			expected:      false,
+			expectedHosts: []string{"partner.example"},
+		},
+		{
+			name:          "oversized response",
+			pubkey:        artistPubkey,
+			identifier:    "oversized@partner.example",
+			expected:      false,
+			expectedHosts: []string{"partner.example"},
+		},
+		{
+			name:       "domain not allowed",
+			pubkey:     artistPubkey,
+			identifier: "artist@elsewhere.example",
+			expected:   false,
+		},
+		{
+			name:     "no identifier",
+			pubkey:   artistPubkey,
+			expected: false,
+		},
+		{
+			name:          "metadata lookup failing",
+			pubkey:        artistPubkey,
+			identifierErr: errors.New("db down"),
+			expected:      false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newNip05Verifier(Nip05GateConfig{Domains: []string{"Partner.example"}}, func(string) (string, error) {
+				return tt.identifier, tt.identifierErr
+			})
+			doer := &localDoer{server: server}
+			v.client = doer
+
+			// Unverified until the fetch lands
+			assert.False(t, v.verified(tt.pubkey))
+			v.pending.Wait()
+			assert.Equal(t, tt.expected, v.verified(tt.pubkey))
+			assert.Equal(t, tt.expectedHosts, doer.hosts)
+		})
+	}
+}
+
+func TestNip05VerifierCache(t *testing.T) {
+	const pubkey = "e6230af84359c4bedd38207a349dfbf8d25ad3b767518e7231fcae03907b9282"
+
+	verified := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if verified {
+			w.Write([]byte(`{"names": {"artist": "` + pubkey + `"}}`))
+		} else {
+			w.Write([]byte(`{"names": {}}`))
+		}
+	}))
+	defer server.Close()
+
+	v := newNip05Verifier(Nip05GateConfig{
+		Domains:          []string{"partner.example"},
+		CacheTTL:         time.Hour,
+		NegativeCacheTTL: time.Minute,
+	}, func(string) (string, error) {
+		return "artist@partner.example", nil
+	})
+	doer := &localDoer{server: server}
+	v.client = doer
+	now := time.Unix(1690000000, 0)
+	v.now = func() time.Time { return now }
+
+	// check waits for any fetch started by verified
+	check := func() bool {
+		v.verified(pubkey)
+		v.pending.Wait()
+		return v.verified(pubkey)
+	}
+
+	assert.True(t, check())
+	verified = false
+	assert.True(t, check())
+	assert.Len(t, doer.hosts, 1)
+
+	// Expired results are kept until the fetch lands
+	now = now.Add(time.Hour)
+	assert.True(t, v.verified(pubkey))
+	v.pending.Wait()
+	assert.False(t, v.verified(pubkey))
+	verified = true
+	assert.False(t, check())
+	assert.Len(t, doer.hosts, 2)
+
+	now = now.Add(time.Minute)
+	assert.True(t, check())
+	assert.Len(t, doer.hosts, 3)
+
+	// New metadata is verified again right away
+	verified = false
+	v.refresh(pubkey)
+	v.pending.Wait()
+	assert.False(t, v.verified(pubkey))
+	assert.Len(t, doer.hosts, 4)
+}
+
+func TestNip05VerifierMaxFetches(t *testing.T) {
+	const pubkey = "e6230af84359c4bedd38207a349dfbf8d25ad3b767518e7231fcae03907b9282"
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(`{"names": {"artist": "` + pubkey + `"}}`))
+	}))
+	defer server.Close()
+
+	v := newNip05Verifier(Nip05GateConfig{
+		Domains:              []string{"partner.example"},
+		MaxConcurrentFetches: 1,
+	}, func(string) (string, error) {
+		return "artist@partner.example", nil
+	})
+	v.client = &localDoer{server: server}
+
+	// Checks don't wait on the fetch, and don't start another while it is
+	// in flight
+	assert.False(t, v.verified(pubkey))
+	assert.False(t, v.verified(pubkey))
+	assert.False(t, v.verified("other"))
+	v.mu.Lock()
+	assert.Len(t, v.inflight, 1)
+	v.mu.Unlock()
+
+	close(release)
+	v.pending.Wait()
+	assert.True(t, v.verified(pubkey))
+	assert.Empty(t, v.inflight)
+}
+
+func TestSubscriptionPolicyNip05Gate(t *testing.T) {
+	p := subscriptionPolicy{
+		kinds: subRequiredKinds,
+		tier: func(pubkey string) (string, bool, error) {
+			return freeTier, false, nil
+		},
+		verified: func(pubkey string) bool {
+			return pubkey == "verified"
+		},
+	}
+
+	ok, _ := p.Evaluate(context.Background(), &nostr.Event{Kind: 1808, PubKey: "verified"})
+	assert.True(t, ok)
+
+	ok, reason := p.Evaluate(context.Background(), &nostr.Event{Kind: 1808, PubKey: "unverified"})
+	assert.False(t, ok)
+	assert.Equal(t, reasonSubscriptionRequired, reason)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	outboxStatusPending = "pending"
+	outboxStatusSending = "sending"
+	outboxStatusSent    = "sent"
+	outboxStatusFailed  = "failed"
+
+	outboxPollInterval = 10 * time.Second
+	outboxSendTimeout  = 30 * time.Second
+	// outboxLease is how long a claimed entry is left to the instance sending
+	// it. An entry whose sender died is sent again once its lease expires.
+	outboxLease = 2 * outboxSendTimeout
+	// outboxRetention is how long sent entries are kept, for the admin UI.
+	outboxRetention     = 7 * 24 * time.Hour
+	outboxPruneInterval = time.Hour
+	outboxBaseBackoff  = 30 * time.Second
+	outboxMaxBackoff   = time.Hour
+	outboxMaxAttempts  = 10
+)
+
+// outbox is a Postgres backed queue of share events. A worker sends them
+// through blastr, retrying failures with exponential backoff. Sent entries
+// are kept for outboxRetention.
+type outbox struct {
+	db     *sqlx.DB
+	blastr blastrIface
+}
+
+type outboxEntry struct {
+	ID            int64     `db:"id"`
+	SourceEventID string    `db:"source_event_id"`
+	Event         string    `db:"event"`
+	Status        string    `db:"status"`
+	Attempts      int       `db:"attempts"`
+	LastError     string    `db:"last_error"`
+	NextAttemptAt time.Time `db:"next_attempt_at"`
+	CreatedAt     time.Time `db:"created_at"`
+	UpdatedAt     time.Time `db:"updated_at"`
+}
+
+func newOutbox(db *sqlx.DB, blastr blastrIface) (*outbox, error) {
+	_, err := db.Exec(`
+CREATE TABLE IF NOT EXISTS blastr_outbox (
+  id bigserial PRIMARY KEY,
+  source_event_id text NOT NULL,
+  event jsonb NOT NULL,
+  status text NOT NULL DEFAULT 'pending',
+  attempts integer NOT NULL DEFAULT 0,
+  last_error text NOT NULL DEFAULT '',
+  next_attempt_at timestamptz NOT NULL DEFAULT NOW(),
+  created_at timestamptz NOT NULL DEFAULT NOW(),
+  updated_at timestamptz NOT NULL DEFAULT NOW()
+);
+
+DROP INDEX IF EXISTS blastr_outbox_pending;
+CREATE INDEX IF NOT EXISTS blastr_outbox_due ON blastr_outbox (next_attempt_at) WHERE status IN ('pending', 'sending');
+CREATE INDEX IF NOT EXISTS blastr_outbox_sent ON blastr_outbox (updated_at) WHERE status = 'sent';
+`)
+	if err != nil {
+		return nil, fmt.Errorf("create table: %w", err)
+	}
+
+	return &outbox{db: db, blastr: blastr}, nil
+}
+
+func (o *outbox) enqueue(ctx context.Context, sourceEventID string, event nostr.Event) error {
+	jsonb, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshal event: %w", err)
+	}
+
+	_, err = o.db.ExecContext(ctx, "INSERT INTO blastr_outbox (source_event_id, event) VALUES ($1, $2)", sourceEventID, jsonb)
+	if err != nil {
+		return fmt.Errorf("insert outbox: %w", err)
+	}
+
+	return nil
+}
+
+// run sends due entries every outboxPollInterval. It never returns.
+func (o *outbox) run() {
+	for range time.Tick(outboxPollInterval) {
+		for {
+			sent, err := o.sendNext()
+			if err != nil {
+				log.Printf("outbox: %v\n", err)
+				break
+			}
+			if !sent {
+				break
+			}
+		}
+	}
+}
+
+// sendNext sends the oldest due entry, reporting false if there was none.
+// The entry is claimed with a lease and committed before sending, so no
+// transaction or row lock is held while blastr is waited on, and other relay
+// instances skip it until the lease expires.
+func (o *outbox) sendNext() (bool, error) {
+	var entry outboxEntry
+	err := o.db.Get(&entry, `UPDATE blastr_outbox
+SET status = 'sending', next_attempt_at = NOW() + make_interval(secs => $1), updated_at = NOW()
+WHERE id = (
+	SELECT id
+	FROM blastr_outbox
+	WHERE status IN ('pending', 'sending')
+		AND next_attempt_at <= NOW()
+	ORDER BY id
+	LIMIT 1
+	FOR UPDATE SKIP LOCKED
+)
+RETURNING id, source_event_id, event, attempts, next_attempt_at`, outboxLease.Seconds())
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("claim due: %w", err)
+	}
+
+	var event nostr.Event
+	if err := json.Unmarshal([]byte(entry.Event), &event); err != nil {
+		return false, fmt.Errorf("unmarshal outbox %d: %w", entry.ID, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), outboxSendTimeout)
+	sendErr := o.blastr.Send(ctx, event)
+	cancel()
+
+	attempts := entry.Attempts + 1
+	status, lastError, nextAttemptAt := outboxSendResult(attempts, sendErr, time.Now())
+	if sendErr != nil {
+		log.Printf("outbox: send %d for %s attempt %d: %v\n", entry.ID, entry.SourceEventID, attempts, sendErr)
+	} else {
+		log.Printf("outbox: sent %d for %s\n", entry.ID, entry.SourceEventID)
+	}
+
+	// The lease identifies the claim: if it expired and the entry was
+	// claimed again, or retried from the admin UI, the result is dropped
+	res, err := o.db.Exec(`UPDATE blastr_outbox
+SET status = $2, attempts = $3, last_error = $4, next_attempt_at = $5, updated_at = NOW()
+WHERE id = $1 AND status = 'sending' AND next_attempt_at = $6`,
+		entry.ID, status, attempts, lastError, nextAttemptAt, entry.NextAttemptAt,
+	)
+	if err != nil {
+		return false, fmt.Errorf("update outbox %d: %w", entry.ID, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		log.Printf("outbox: lease on %d expired, dropping the result\n", entry.ID)
+	}
+
+	return true, nil
+}
+
+// prune deletes sent entries older than outboxRetention every
+// outboxPruneInterval. It never returns.
+func (o *outbox) prune() {
+	for range time.Tick(outboxPruneInterval) {
+		res, err := o.db.Exec("DELETE FROM blastr_outbox WHERE status = 'sent' AND updated_at < $1", time.Now().Add(-outboxRetention))
+		if err != nil {
+			log.Printf("[error] prune outbox: %v\n", err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			log.Printf("outbox: pruned %d sent entries\n", n)
+		}
+	}
+}
+
+// outboxSendResult returns the state of an entry after its attempts'th
+// send returned sendErr.
+func outboxSendResult(attempts int, sendErr error, now time.Time) (status, lastError string, nextAttemptAt time.Time) {
+	if sendErr == nil {
+		return outboxStatusSent, "", now
+	}
+
+	if attempts >= outboxMaxAttempts {
+		return outboxStatusFailed, sendErr.Error(), now
+	}
+
+	return outboxStatusPending, sendErr.Error(), now.Add(outboxBackoff(attempts))
+}
+
+// outboxBackoff doubles the delay after every failed attempt.
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxBaseBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= outboxMaxBackoff {
+			return outboxMaxBackoff
+		}
+	}
+
+	return backoff
+}
+
+// list returns the latest entries, optionally only those with status.
+func (o *outbox) list(status string, limit int) ([]outboxEntry, error) {
+	var entries []outboxEntry
+	err := o.db.Select(&entries, `SELECT id, source_event_id, event, status, attempts, last_error, next_attempt_at, created_at, updated_at
+FROM blastr_outbox
+WHERE $1 = '' OR status = $1
+ORDER BY id DESC
+LIMIT $2`, status, limit)
+	if err != nil {
+		return nil, fmt.Errorf("select outbox: %w", err)
+	}
+
+	return entries, nil
+}
+
+// retry makes an entry due right away, whatever its status.
+func (o *outbox) retry(id int64) error {
+	res, err := o.db.Exec(`UPDATE blastr_outbox
+SET status = 'pending', next_attempt_at = NOW(), updated_at = NOW()
+WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("update outbox: %w", err)
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("outbox entry %d not found", id)
+	}
+
+	return nil
+}
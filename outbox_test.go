@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	var tests = []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{attempts: 1, expected: 30 * time.Second},
+		{attempts: 2, expected: time.Minute},
+		{attempts: 3, expected: 2 * time.Minute},
+		{attempts: 7, expected: 32 * time.Minute},
+		{attempts: 8, expected: time.Hour},
+		{attempts: 100, expected: time.Hour},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, outboxBackoff(tt.attempts), "attempts: %d", tt.attempts)
+	}
+}
+
+func TestOutboxSendResult(t *testing.T) {
+	now := time.Unix(1690000000, 0)
+	sendErr := errors.New("relay unreachable")
+
+	var tests = []struct {
+		name              string
+		attempts          int
+		sendErr           error
+		expectedStatus    string
+		expectedLastError string
+		expectedNext      time.Time
+	}{
+		{
+			name:           "sent",
+			attempts:       3,
+			expectedStatus: outboxStatusSent,
+			expectedNext:   now,
+		},
+		{
+			name:              "retry with backoff",
+			attempts:          2,
+			sendErr:           sendErr,
+			expectedStatus:    outboxStatusPending,
+			expectedLastError: "relay unreachable",
+			expectedNext:      now.Add(time.Minute),
+		},
+		{
+			name:              "give up after max attempts",
+			attempts:          outboxMaxAttempts,
+			sendErr:           sendErr,
+			expectedStatus:    outboxStatusFailed,
+			expectedLastError: "relay unreachable",
+			expectedNext:      now,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, lastError, next := outboxSendResult(tt.attempts, tt.sendErr, now)
+			assert.Equal(t, tt.expectedStatus, status)
+			assert.Equal(t, tt.expectedLastError, lastError)
+			assert.Equal(t, tt.expectedNext, next)
+		})
+	}
+}
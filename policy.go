@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Policy decides whether an incoming event is accepted by the relay.
+type Policy interface {
+	// Name identifies the policy in config and logs.
+	Name() string
+	// Evaluate returns false and a NIP-20 prefixed reason to reject evt.
+	Evaluate(ctx context.Context, evt *nostr.Event) (ok bool, reason string)
+}
+
+// Rejection reasons sent to clients in the NIP-20 OK message. The prefix
+// before the colon is machine-readable.
+const (
+	reasonTooLarge                = "invalid: event too large"
+	reasonSubscriptionRequired    = "blocked: subscription required"
+	reasonSubscriptionCheckFailed = "error: could not check subscription"
+	reasonTierNotAllowed          = "blocked: subscription tier does not allow this kind"
+	reasonUnknownTextNoteOrigin   = "restricted: must be from a trusted client or reference a known event"
+	reasonMustReferenceKnownEvent = "restricted: must reference a known event"
+	reasonTrackNotFromClient      = "restricted: tracks must be published from a trusted client"
+)
+
+// policyPipeline evaluates policies in order. The first rejection wins.
+type policyPipeline []Policy
+
+func (p policyPipeline) evaluate(ctx context.Context, evt *nostr.Event) (bool, string) {
+	for _, policy := range p {
+		if ok, reason := policy.Evaluate(ctx, evt); !ok {
+			log.Printf("rejected event %s by policy %s: %s\n", evt.ID, policy.Name(), reason)
+			return false, reason
+		}
+	}
+
+	return true, ""
+}
+
+// policyDeps holds everything the built-in policies need from the relay.
+type policyDeps struct {
+	cfg           Config
+	storage       *storage
+	subscriptions *subscriptionCache
+	limits        *rateLimiters
+	attestations  *attestationVerifier
+	// nip05, if set, lets verified authors publish without a subscription.
+	nip05 *nip05Verifier
+	// wot, if set, lets authors close to the seeds reply and react to
+	// events the relay doesn't know.
+	wot *webOfTrust
+}
+
+// builtinPolicies maps config names to constructors for the policies that
+// ship with the relay.
+var builtinPolicies = map[string]func(policyDeps) Policy{
+	"access_list": func(d policyDeps) Policy {
+		return accessListPolicy{storage: d.storage}
+	},
+	"allowed_kinds": func(d policyDeps) Policy {
+		return allowedKindsPolicy{kinds: d.cfg.AllowedKinds}
+	},
+	"max_event_size": func(d policyDeps) Policy {
+		maxSize := d.cfg.Limits.MaxEventSize
+		if maxSize <= 0 {
+			maxSize = defaultMaxEventSize
+		}
+		return maxEventSizePolicy{maxSize: maxSize, kindMaxSize: d.cfg.Limits.KindMaxEventSize}
+	},
+	"event_limits": func(d policyDeps) Policy {
+		return eventLimitsPolicy{
+			maxTags:           d.cfg.Limits.MaxTags,
+			maxTagValueLength: d.cfg.Limits.MaxTagValueLength,
+			maxContentLength:  d.cfg.Limits.MaxContentLength,
+		}
+	},
+	"required_tags": func(d policyDeps) Policy {
+		tags := d.cfg.Limits.RequiredTags
+		if tags == nil {
+			tags = defaultRequiredTags
+		}
+		return requiredTagsPolicy{tags: tags}
+	},
+	"track_schema": func(d policyDeps) Policy {
+		return trackSchemaPolicy{validator: trackValidator{mediaHosts: d.cfg.Limits.TrackMediaHosts}}
+	},
+	"rate_limit": func(d policyDeps) Policy {
+		return rateLimitPolicy{limits: d.limits}
+	},
+	"auth": func(d policyDeps) Policy {
+		return authPolicy{
+			requireForPublish: d.cfg.Auth.RequireForPublish,
+			subscriptionKinds: d.cfg.SubscriptionKinds,
+		}
+	},
+	"subscription": func(d policyDeps) Policy {
+		p := subscriptionPolicy{
+			kinds: d.cfg.SubscriptionKinds,
+			tiers: d.cfg.SubscriptionTiers,
+			tier:  d.subscriptions.tier,
+		}
+		if d.nip05 != nil {
+			p.verified = d.nip05.verified
+		}
+		return p
+	},
+	"text_note_origin": func(d policyDeps) Policy {
+		return textNoteOriginPolicy{storage: d.storage, clients: d.attestations, wot: d.wot}
+	},
+	"references_known_event": func(d policyDeps) Policy {
+		return referencesKnownEventPolicy{storage: d.storage, wot: d.wot}
+	},
+	"track_origin": func(d policyDeps) Policy {
+		return trackOriginPolicy{clients: d.attestations}
+	},
+}
+
+// defaultPolicies is the pipeline used when Config.Policies is empty.
+var defaultPolicies = []string{
+	"access_list",
+	"allowed_kinds",
+	"max_event_size",
+	"event_limits",
+	"required_tags",
+	"track_schema",
+	"rate_limit",
+	"auth",
+	"subscription",
+	"text_note_origin",
+	"references_known_event",
+	"track_origin",
+}
+
+// newPolicyPipeline builds the pipeline named by cfg.Policies, skipping any
+// listed in cfg.DisabledPolicies.
+func newPolicyPipeline(d policyDeps) (policyPipeline, error) {
+	names := d.cfg.Policies
+	if len(names) == 0 {
+		names = defaultPolicies
+	}
+
+	disabled := make(map[string]bool, len(d.cfg.DisabledPolicies))
+	for _, name := range d.cfg.DisabledPolicies {
+		disabled[name] = true
+	}
+
+	var pipeline policyPipeline
+	for _, name := range names {
+		if disabled[name] {
+			continue
+		}
+
+		newPolicy, ok := builtinPolicies[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown policy %q", name)
+		}
+		pipeline = append(pipeline, newPolicy(d))
+	}
+
+	return pipeline, nil
+}
+
+// allowedKindsPolicy rejects any kinds not explicitly allowed.
+type allowedKindsPolicy struct {
+	kinds []int
+}
+
+func (p allowedKindsPolicy) Name() string { return "allowed_kinds" }
+
+func (p allowedKindsPolicy) Evaluate(ctx context.Context, evt *nostr.Event) (bool, string) {
+	for _, kind := range p.kinds {
+		if evt.Kind == kind {
+			return true, ""
+		}
+	}
+
+	return false, fmt.Sprintf("blocked: kind %d is not allowed", evt.Kind)
+}
+
+const defaultMaxEventSize = 10000
+
+// maxEventSizePolicy rejects events whose JSON encoding is too large.
+type maxEventSizePolicy struct {
+	maxSize int
+	// kindMaxSize overrides maxSize for some kinds.
+	kindMaxSize map[int]int
+}
+
+func (p maxEventSizePolicy) Name() string { return "max_event_size" }
+
+func (p maxEventSizePolicy) Evaluate(ctx context.Context, evt *nostr.Event) (bool, string) {
+	maxSize := p.maxSize
+	if kindMax, ok := p.kindMaxSize[evt.Kind]; ok {
+		maxSize = kindMax
+	}
+
+	jsonb, _ := json.Marshal(evt)
+	if len(jsonb) > maxSize {
+		return false, reasonTooLarge
+	}
+
+	return true, ""
+}
+
+// subscriptionPolicy requires the author's subscription tier to allow
+// publishing kinds that require a subscription.
+type subscriptionPolicy struct {
+	kinds []int
+	tiers map[string]TierConfig
+	tier  func(pubkey string) (tier string, subscribed bool, err error)
+	// verified, if set, reports whether an unsubscribed author may publish
+	// anyway.
+	verified func(pubkey string) bool
+}
+
+func (p subscriptionPolicy) Name() string { return "subscription" }
+
+func (p subscriptionPolicy) Evaluate(ctx context.Context, evt *nostr.Event) (bool, string) {
+	if !kindRequiresSubscription(p.kinds, evt.Kind) {
+		return true, ""
+	}
+
+	tier, subscribed, err := p.tier(evt.PubKey)
+	if err != nil {
+		log.Printf("subscription tier: %v\n", err)
+		return false, reasonSubscriptionCheckFailed
+	}
+
+	if !kindAllowedForTier(p.tiers, tier, evt.Kind) {
+		if !subscribed {
+			if p.verified != nil && p.verified(evt.PubKey) {
+				return true, ""
+			}
+			return false, reasonSubscriptionRequired
+		}
+		return false, reasonTierNotAllowed
+	}
+
+	if max := p.tiers[tier].MaxEventSize; max > 0 {
+		if jsonb, _ := json.Marshal(evt); len(jsonb) > max {
+			return false, reasonTooLarge
+		}
+	}
+
+	return true, ""
+}
+
+// textNoteOriginPolicy requires kind 1's to be from a trusted client, by an
+// author in the web of trust, or else reference a known event.
+type textNoteOriginPolicy struct {
+	storage *storage
+	clients *attestationVerifier
+	wot     *webOfTrust
+}
+
+func (p textNoteOriginPolicy) Name() string { return "text_note_origin" }
+
+func (p textNoteOriginPolicy) Evaluate(ctx context.Context, evt *nostr.Event) (bool, string) {
+	if evt.Kind != nostr.KindTextNote {
+		return true, ""
+	}
+
+	if !p.clients.trusted(evt) && !p.wot.trusted(evt.PubKey) && !p.storage.referencesKnownEvent(evt) {
+		return false, reasonUnknownTextNoteOrigin
+	}
+
+	return true, ""
+}
+
+// referencesKnownEventPolicy requires reactions and reposts to reference a
+// known event, unless their author is in the web of trust.
+type referencesKnownEventPolicy struct {
+	storage *storage
+	wot     *webOfTrust
+}
+
+func (p referencesKnownEventPolicy) Name() string { return "references_known_event" }
+
+func (p referencesKnownEventPolicy) Evaluate(ctx context.Context, evt *nostr.Event) (bool, string) {
+	if evt.Kind != nostr.KindReaction && evt.Kind != 6 && evt.Kind != 16 {
+		return true, ""
+	}
+
+	if !p.wot.trusted(evt.PubKey) && !p.storage.referencesKnownEvent(evt) {
+		return false, reasonMustReferenceKnownEvent
+	}
+
+	return true, ""
+}
+
+// trackOriginPolicy only allows 1808s from a trusted client.
+type trackOriginPolicy struct {
+	clients *attestationVerifier
+}
+
+func (p trackOriginPolicy) Name() string { return "track_origin" }
+
+func (p trackOriginPolicy) Evaluate(ctx context.Context, evt *nostr.Event) (bool, string) {
+	if evt.Kind == 1808 && !p.clients.trusted(evt) {
+		return false, reasonTrackNotFromClient
+	}
+
+	return true, ""
+}
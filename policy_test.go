@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPolicyPipeline(t *testing.T) {
+	var tests = []struct {
+		name          string
+		policies      []string
+		disabled      []string
+		expectedNames []string
+		expectedErr   bool
+	}{
+		{
+			name:          "defaults",
+			expectedNames: defaultPolicies,
+		},
+		{
+			name:          "reordered",
+			policies:      []string{"track_origin", "allowed_kinds"},
+			expectedNames: []string{"track_origin", "allowed_kinds"},
+		},
+		{
+			name:          "disabled",
+			disabled:      []string{"subscription", "max_event_size"},
+			expectedNames: []string{"access_list", "allowed_kinds", "event_limits", "required_tags", "track_schema", "rate_limit", "auth", "text_note_origin", "references_known_event", "track_origin"},
+		},
+		{
+			name:        "unknown policy",
+			policies:    []string{"allowed_kinds", "nope"},
+			expectedErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipeline, err := newPolicyPipeline(policyDeps{
+				cfg: Config{
+					Policies:         tt.policies,
+					DisabledPolicies: tt.disabled,
+				},
+			})
+			if tt.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			var names []string
+			for _, p := range pipeline {
+				names = append(names, p.Name())
+			}
+			assert.Equal(t, tt.expectedNames, names)
+		})
+	}
+}
+
+func TestPolicyPipelineFirstRejectionWins(t *testing.T) {
+	pipeline := policyPipeline{
+		allowedKindsPolicy{kinds: []int{1}},
+		maxEventSizePolicy{maxSize: 10},
+		allowedKindsPolicy{kinds: []int{}},
+	}
+
+	ok, reason := pipeline.evaluate(context.Background(), &nostr.Event{Kind: 1, Content: "way more than ten bytes"})
+	assert.False(t, ok)
+	assert.Equal(t, reasonTooLarge, reason)
+
+	ok, reason = policyPipeline{}.evaluate(context.Background(), &nostr.Event{Kind: 1})
+	assert.True(t, ok)
+	assert.Equal(t, "", reason)
+}
+
+func TestAllowedKindsPolicy(t *testing.T) {
+	p := allowedKindsPolicy{kinds: defaultAllowedKinds}
+
+	ok, _ := p.Evaluate(context.Background(), &nostr.Event{Kind: 1808})
+	assert.True(t, ok)
+
+	ok, _ = p.Evaluate(context.Background(), &nostr.Event{Kind: 4})
+	assert.False(t, ok)
+}
+
+func TestMaxEventSizePolicy(t *testing.T) {
+	p := maxEventSizePolicy{maxSize: defaultMaxEventSize}
+
+	ok, _ := p.Evaluate(context.Background(), &nostr.Event{Kind: 1, Content: "small"})
+	assert.True(t, ok)
+
+	ok, _ = p.Evaluate(context.Background(), &nostr.Event{Kind: 1, Content: strings.Repeat("x", defaultMaxEventSize)})
+	assert.False(t, ok)
+
+	p.kindMaxSize = map[int]int{3: 2 * defaultMaxEventSize, 7: 200}
+
+	ok, _ = p.Evaluate(context.Background(), &nostr.Event{Kind: 3, Content: strings.Repeat("x", defaultMaxEventSize)})
+	assert.True(t, ok)
+
+	ok, _ = p.Evaluate(context.Background(), &nostr.Event{Kind: 7, Content: strings.Repeat("x", 300)})
+	assert.False(t, ok)
+}
+
+func TestSubscriptionPolicy(t *testing.T) {
+	tiers := map[string]TierConfig{
+		freeTier: {Kinds: []int{6, 16}},
+		"paid":   {Kinds: []int{1, 6, 16, 1808}, MaxEventSize: 200},
+	}
+
+	var tests = []struct {
+		name       string
+		tiers      map[string]TierConfig
+		kind       int
+		content    string
+		tier       string
+		subscribed bool
+		err        error
+		expected   string
+	}{
+		{
+			name:     "kind does not require sub",
+			kind:     nostr.KindReaction,
+			tier:     freeTier,
+			expected: "",
+		},
+		{
+			name:       "subscribed",
+			kind:       1808,
+			tier:       "paid",
+			subscribed: true,
+			expected:   "",
+		},
+		{
+			name:     "not subscribed",
+			kind:     1808,
+			tier:     freeTier,
+			expected: reasonSubscriptionRequired,
+		},
+		{
+			name:     "lookup error",
+			kind:     1,
+			err:      errors.New("db down"),
+			expected: reasonSubscriptionCheckFailed,
+		},
+		{
+			name:     "free tier repost",
+			tiers:    tiers,
+			kind:     6,
+			tier:     freeTier,
+			expected: "",
+		},
+		{
+			name:     "free tier track",
+			tiers:    tiers,
+			kind:     1808,
+			tier:     freeTier,
+			expected: reasonSubscriptionRequired,
+		},
+		{
+			name:       "paid tier track",
+			tiers:      tiers,
+			kind:       1808,
+			tier:       "paid",
+			subscribed: true,
+			expected:   "",
+		},
+		{
+			name:       "paid tier track too large",
+			tiers:      tiers,
+			kind:       1808,
+			content:    strings.Repeat("x", 200),
+			tier:       "paid",
+			subscribed: true,
+			expected:   reasonTooLarge,
+		},
+		{
+			name:       "unknown tier",
+			tiers:      tiers,
+			kind:       1808,
+			tier:       "legacy",
+			subscribed: true,
+			expected:   reasonTierNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := subscriptionPolicy{
+				kinds: subRequiredKinds,
+				tiers: tt.tiers,
+				tier: func(pubkey string) (string, bool, error) {
+					return tt.tier, tt.subscribed, tt.err
+				},
+			}
+
+			ok, reason := p.Evaluate(context.Background(), &nostr.Event{Kind: tt.kind, Content: tt.content})
+			assert.Equal(t, tt.expected == "", ok)
+			assert.Equal(t, tt.expected, reason)
+		})
+	}
+}
+
+func TestTextNoteOriginPolicy(t *testing.T) {
+	f := newSeenFilter(1000, 0.01)
+	f.Add([]byte("12345"))
+	wot := newWebOfTrust(WebOfTrustConfig{Seeds: []string{"seed"}}, func([]string) (map[string]contactList, error) {
+		return map[string]contactList{"seed": {follows: []string{"friend"}}}, nil
+	})
+	assert.NoError(t, wot.rebuild())
+	p := textNoteOriginPolicy{storage: &storage{seenEvents: f}, wot: wot}
+
+	var tests = []struct {
+		name     string
+		event    *nostr.Event
+		expected bool
+	}{
+		{
+			name:     "other kind",
+			event:    &nostr.Event{Kind: nostr.KindReaction},
+			expected: true,
+		},
+		{
+			name:     "from stemstr client",
+			event:    &nostr.Event{Kind: 1, Tags: nostr.Tags{{"client", "stemstr.app"}}},
+			expected: true,
+		},
+		{
+			name:     "reply to known event",
+			event:    &nostr.Event{Kind: 1, Tags: nostr.Tags{{"e", "12345"}}},
+			expected: true,
+		},
+		{
+			name:     "author in web of trust",
+			event:    &nostr.Event{Kind: 1, PubKey: "friend", Tags: nostr.Tags{{"e", "yyy"}}},
+			expected: true,
+		},
+		{
+			name:     "unknown origin",
+			event:    &nostr.Event{Kind: 1, PubKey: "stranger", Tags: nostr.Tags{{"e", "yyy"}}},
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, _ := p.Evaluate(context.Background(), tt.event)
+			assert.Equal(t, tt.expected, ok)
+		})
+	}
+}
+
+func TestReferencesKnownEventPolicy(t *testing.T) {
+	f := newSeenFilter(1000, 0.01)
+	f.Add([]byte("12345"))
+	wot := newWebOfTrust(WebOfTrustConfig{Seeds: []string{"seed"}}, func([]string) (map[string]contactList, error) {
+		return map[string]contactList{"seed": {follows: []string{"friend"}}}, nil
+	})
+	assert.NoError(t, wot.rebuild())
+	p := referencesKnownEventPolicy{storage: &storage{seenEvents: f}, wot: wot}
+
+	ok, _ := p.Evaluate(context.Background(), &nostr.Event{Kind: 1808})
+	assert.True(t, ok)
+
+	ok, _ = p.Evaluate(context.Background(), &nostr.Event{Kind: 6, Tags: nostr.Tags{{"e", "12345"}}})
+	assert.True(t, ok)
+
+	ok, _ = p.Evaluate(context.Background(), &nostr.Event{Kind: nostr.KindReaction, PubKey: "friend", Tags: nostr.Tags{{"e", "yyy"}}})
+	assert.True(t, ok)
+
+	ok, _ = p.Evaluate(context.Background(), &nostr.Event{Kind: nostr.KindReaction, Tags: nostr.Tags{{"e", "yyy"}}})
+	assert.False(t, ok)
+}
+
+func TestTrackOriginPolicy(t *testing.T) {
+	p := trackOriginPolicy{}
+
+	ok, _ := p.Evaluate(context.Background(), &nostr.Event{Kind: 1808, Tags: nostr.Tags{{"client", "stemstr.app"}}})
+	assert.True(t, ok)
+
+	ok, _ = p.Evaluate(context.Background(), &nostr.Event{Kind: 1808})
+	assert.False(t, ok)
+
+	ok, _ = p.Evaluate(context.Background(), &nostr.Event{Kind: 1})
+	assert.True(t, ok)
+}
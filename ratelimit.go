@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/relayer/v2"
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/time/rate"
+)
+
+const reasonRateLimited = "rate-limited: slow down, too many events of this kind"
+
+// reasonReadRateLimited ends a refused REQ or COUNT with CLOSED.
+const reasonReadRateLimited = "rate-limited: slow down, too many requests"
+
+const (
+	// keyedLimiterPruneInterval is how often idle buckets are dropped.
+	keyedLimiterPruneInterval = time.Minute
+	// rateLimitStatsTopKeys is how many of the most limited keys are shown
+	// in the stats.
+	rateLimitStatsTopKeys = 20
+)
+
+// defaultConnectionMessageRateLimit applies to every message on a
+// connection when rate_limits.connection isn't configured.
+var defaultConnectionMessageRateLimit = RateLimit{Every: 100 * time.Millisecond, Burst: 10}
+
+// defaultEventRateLimits apply when rate_limits.events isn't configured.
+// Tracks are expensive to store and announce, reactions are cheap.
+var defaultEventRateLimits = EventRateLimits{
+	Default: RateLimit{Every: time.Second, Burst: 20},
+	Kinds: map[int]RateLimit{
+		nostr.KindReaction: {Every: 200 * time.Millisecond, Burst: 50},
+		1808:               {Every: 5 * time.Minute, Burst: 5},
+		1063:               {Every: 5 * time.Minute, Burst: 5},
+	},
+}
+
+// defaultIPEventRateLimits apply when rate_limits.ip_events isn't
+// configured. They are looser than the per pubkey limits, as one IP may be
+// a NAT or proxy shared by many users, and mostly stop one client cycling
+// through fresh keys.
+var defaultIPEventRateLimits = EventRateLimits{
+	Default: RateLimit{Every: 200 * time.Millisecond, Burst: 100},
+	Kinds: map[int]RateLimit{
+		nostr.KindReaction: {Every: 50 * time.Millisecond, Burst: 200},
+		1808:               {Every: time.Minute, Burst: 20},
+		1063:               {Every: time.Minute, Burst: 20},
+	},
+}
+
+// defaultConnectionRateLimit applies when rate_limits.connections isn't
+// configured.
+var defaultConnectionRateLimit = RateLimit{Every: time.Second, Burst: 30}
+
+// keyedLimiter is a token bucket per key, e.g. per pubkey or per IP.
+type keyedLimiter struct {
+	cfg   RateLimit
+	limit rate.Limit
+	// idle is how long until an unused bucket is full again, at which point
+	// it's no different from a new one and can be dropped.
+	idle time.Duration
+	now  func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*keyedBucket
+	nextPrune time.Time
+
+	allowed atomic.Uint64
+	limited atomic.Uint64
+}
+
+type keyedBucket struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+	limited  uint64
+}
+
+type keyedLimiterStats struct {
+	Every   string            `json:"every"`
+	Burst   int               `json:"burst"`
+	Keys    int               `json:"keys"`
+	Allowed uint64            `json:"allowed"`
+	Limited uint64            `json:"limited"`
+	TopKeys []limitedKeyStats `json:"top_limited_keys,omitempty"`
+}
+
+type limitedKeyStats struct {
+	Key      string    `json:"key"`
+	Limited  uint64    `json:"limited"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+func newKeyedLimiter(l RateLimit) *keyedLimiter {
+	return &keyedLimiter{
+		cfg:     l,
+		limit:   rate.Every(l.Every),
+		idle:    l.Every * time.Duration(l.Burst),
+		now:     time.Now,
+		buckets: make(map[string]*keyedBucket),
+	}
+}
+
+// allow takes a token from key's bucket, reporting false if it is empty.
+func (l *keyedLimiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.prune(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &keyedBucket{limiter: rate.NewLimiter(l.limit, l.cfg.Burst)}
+		l.buckets[key] = b
+	}
+	b.lastUsed = now
+
+	if !b.limiter.AllowN(now, 1) {
+		b.limited++
+		l.limited.Add(1)
+		return false
+	}
+
+	l.allowed.Add(1)
+	return true
+}
+
+// prune drops buckets that have refilled. l.mu must be held.
+func (l *keyedLimiter) prune(now time.Time) {
+	if now.Before(l.nextPrune) {
+		return
+	}
+	l.nextPrune = now.Add(keyedLimiterPruneInterval)
+
+	for key, b := range l.buckets {
+		if now.Sub(b.lastUsed) >= l.idle {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *keyedLimiter) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.buckets)
+}
+
+func (l *keyedLimiter) stats() keyedLimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := keyedLimiterStats{
+		Every:   l.cfg.Every.String(),
+		Burst:   l.cfg.Burst,
+		Keys:    len(l.buckets),
+		Allowed: l.allowed.Load(),
+		Limited: l.limited.Load(),
+	}
+	for key, b := range l.buckets {
+		if b.limited > 0 {
+			stats.TopKeys = append(stats.TopKeys, limitedKeyStats{Key: key, Limited: b.limited, LastUsed: b.lastUsed})
+		}
+	}
+	sort.Slice(stats.TopKeys, func(i, j int) bool {
+		return stats.TopKeys[i].Limited > stats.TopKeys[j].Limited
+	})
+	if len(stats.TopKeys) > rateLimitStatsTopKeys {
+		stats.TopKeys = stats.TopKeys[:rateLimitStatsTopKeys]
+	}
+
+	return stats
+}
+
+// eventRateLimiter limits how fast each key, a pubkey or an IP, may publish
+// each kind.
+type eventRateLimiter struct {
+	kinds map[int]*keyedLimiter
+	// fallback limits kinds without their own limit.
+	fallback *keyedLimiter
+}
+
+// newEventRateLimiter creates the limits in cfg, or defaults if cfg is
+// empty.
+func newEventRateLimiter(cfg, defaults EventRateLimits) *eventRateLimiter {
+	if cfg.Default.Every <= 0 && len(cfg.Kinds) == 0 {
+		cfg = defaults
+	}
+
+	l := &eventRateLimiter{kinds: make(map[int]*keyedLimiter)}
+	if cfg.Default.Every > 0 {
+		l.fallback = newKeyedLimiter(cfg.Default)
+	}
+	for kind, limit := range cfg.Kinds {
+		l.kinds[kind] = newKeyedLimiter(limit)
+	}
+
+	return l
+}
+
+func (l *eventRateLimiter) allow(key string, kind int) bool {
+	limiter, ok := l.kinds[kind]
+	if !ok {
+		limiter = l.fallback
+	}
+	if limiter == nil {
+		return true
+	}
+
+	return limiter.allow(key)
+}
+
+func (l *eventRateLimiter) stats() map[string]keyedLimiterStats {
+	stats := make(map[string]keyedLimiterStats)
+	if l.fallback != nil {
+		stats["default"] = l.fallback.stats()
+	}
+	for kind, limiter := range l.kinds {
+		stats[strconv.Itoa(kind)] = limiter.stats()
+	}
+
+	return stats
+}
+
+// rateLimiters are the relay's limits beyond the relayer's per-connection
+// one. Exempt pubkeys and IPs bypass them.
+type rateLimiters struct {
+	events *eventRateLimiter
+	// ipEvents limits how fast each client IP may publish each kind,
+	// whichever pubkeys it signs with.
+	ipEvents *eventRateLimiter
+	// reads, if set, limits REQs per client IP.
+	reads       *keyedLimiter
+	connections *keyedLimiter
+
+	exemptPubkeys map[string]bool
+	exemptIPs     map[string]bool
+}
+
+type rateLimitStats struct {
+	Events        map[string]keyedLimiterStats `json:"events"`
+	IPEvents      map[string]keyedLimiterStats `json:"ip_events"`
+	Reads         *keyedLimiterStats           `json:"reads,omitempty"`
+	Connections   keyedLimiterStats            `json:"connections"`
+	ExemptPubkeys []string                     `json:"exempt_pubkeys"`
+	ExemptIPs     []string                     `json:"exempt_ips"`
+}
+
+// newRateLimiters creates the limiters in cfg, exempting exemptPubkeys on
+// top of the configured ones.
+func newRateLimiters(cfg RateLimitConfig, exemptPubkeys ...string) *rateLimiters {
+	connections := cfg.Connections
+	if connections.Every <= 0 {
+		connections = defaultConnectionRateLimit
+	}
+
+	l := &rateLimiters{
+		events:        newEventRateLimiter(cfg.Events, defaultEventRateLimits),
+		ipEvents:      newEventRateLimiter(cfg.IPEvents, defaultIPEventRateLimits),
+		connections:   newKeyedLimiter(connections),
+		exemptPubkeys: make(map[string]bool),
+		exemptIPs:     make(map[string]bool),
+	}
+	if cfg.Reads.Every > 0 {
+		l.reads = newKeyedLimiter(cfg.Reads)
+	}
+
+	for _, pubkey := range append(cfg.ExemptPubkeys, exemptPubkeys...) {
+		l.exemptPubkeys[pubkey] = true
+	}
+	for _, ip := range cfg.ExemptIPs {
+		l.exemptIPs[ip] = true
+	}
+
+	return l
+}
+
+// allowEvent takes a token from both the pubkey's and the IP's bucket for
+// kind. ip is empty if unknown, e.g. for events not sent over a connection.
+func (l *rateLimiters) allowEvent(pubkey, ip string, kind int) bool {
+	if l.exemptPubkeys[pubkey] {
+		return true
+	}
+
+	if !l.events.allow(pubkey, kind) {
+		return false
+	}
+	if ip == "" || l.exemptIPs[ip] {
+		return true
+	}
+
+	return l.ipEvents.allow(ip, kind)
+}
+
+// allowRead limits REQs per client IP, whether or not the connection
+// authenticated, so reconnecting or rotating keys doesn't reset the bucket.
+// Connections authenticated as an exempt pubkey aren't limited.
+func (l *rateLimiters) allowRead(ctx context.Context) bool {
+	if l.reads == nil || isAdminContext(ctx) {
+		return true
+	}
+
+	if pubkey, ok := authedPubkey(ctx); ok && l.exemptPubkeys[pubkey] {
+		return true
+	}
+	ip, ok := connectionIP(ctx)
+	if !ok || l.exemptIPs[ip] {
+		return true
+	}
+
+	return l.reads.allow(ip)
+}
+
+func (l *rateLimiters) allowConnection(ip string) bool {
+	if l.exemptIPs[ip] {
+		return true
+	}
+
+	return l.connections.allow(ip)
+}
+
+func (l *rateLimiters) stats() rateLimitStats {
+	stats := rateLimitStats{
+		Events:        l.events.stats(),
+		IPEvents:      l.ipEvents.stats(),
+		Connections:   l.connections.stats(),
+		ExemptPubkeys: sortedKeys(l.exemptPubkeys),
+		ExemptIPs:     sortedKeys(l.exemptIPs),
+	}
+	if l.reads != nil {
+		reads := l.reads.stats()
+		stats.Reads = &reads
+	}
+
+	return stats
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// rateLimitPolicy rejects events from pubkeys or client IPs publishing a kind
+// too fast.
+type rateLimitPolicy struct {
+	limits *rateLimiters
+}
+
+func (rateLimitPolicy) Name() string { return "rate_limit" }
+
+func (p rateLimitPolicy) Evaluate(ctx context.Context, evt *nostr.Event) (bool, string) {
+	if isAdminContext(ctx) {
+		return true, ""
+	}
+
+	ip, _ := connectionIP(ctx)
+	if !p.limits.allowEvent(evt.PubKey, ip, evt.Kind) {
+		return false, reasonRateLimited
+	}
+
+	return true, ""
+}
+
+// connectionLimiter limits how fast each client IP may open websocket
+// connections, so reconnecting doesn't reset the per-connection limiter.
+// It also turns away blocked IPs; connections already open are checked on
+// each event and REQ.
+type connectionLimiter struct {
+	next   http.Handler
+	limits *rateLimiters
+	access *accessList
+	// trustForwardedFor takes the client IP from X-Forwarded-For, which is
+	// only safe behind a proxy that sets it.
+	trustForwardedFor bool
+}
+
+func (c connectionLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isWebsocketUpgrade(r) {
+		ip := clientIP(r, c.trustForwardedFor)
+		if ok, entry := c.access.allowIP(ip); !ok {
+			log.Printf("blocked connection from %s by access list entry %d\n", ip, entry.ID)
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(reasonIPBlocked))
+			return
+		}
+		if !c.limits.allowConnection(ip) {
+			log.Printf("rate limited connection from %s\n", ip)
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte("rate-limited: too many connections"))
+			return
+		}
+	}
+
+	c.next.ServeHTTP(w, r)
+}
+
+// isWebsocketUpgrade reports whether r asks to upgrade to a websocket. The
+// Upgrade header is matched the way the websocket library does, case
+// insensitively and in any of its comma-separated tokens, so no variation of
+// it bypasses the connection checks.
+func isWebsocketUpgrade(r *http.Request) bool {
+	for _, values := range r.Header.Values("Upgrade") {
+		for _, token := range strings.Split(values, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "websocket") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// clientIP returns the IP of the client making r. Behind a proxy the last
+// X-Forwarded-For entry is the one the proxy added; earlier ones come from
+// the client and can't be trusted.
+func clientIP(r *http.Request, trustForwardedFor bool) string {
+	if trustForwardedFor {
+		forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		for i := len(forwarded) - 1; i >= 0; i-- {
+			if ip := strings.TrimSpace(forwarded[i]); ip != "" {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// connectionIP returns the client IP of the connection ctx was created for,
+// which our relayer fork attaches to the context of every message.
+func connectionIP(ctx context.Context) (string, bool) {
+	return relayer.GetClientIP(ctx)
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/relayer/v2"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyedLimiter(t *testing.T) {
+	l := newKeyedLimiter(RateLimit{Every: time.Minute, Burst: 2})
+	now := time.Unix(1690000000, 0)
+	l.now = func() time.Time { return now }
+
+	assert.True(t, l.allow("a"))
+	assert.True(t, l.allow("a"))
+	assert.False(t, l.allow("a"))
+	// Buckets are independent
+	assert.True(t, l.allow("b"))
+
+	now = now.Add(time.Minute)
+	assert.True(t, l.allow("a"))
+	assert.False(t, l.allow("a"))
+
+	// Buckets idle long enough to refill are dropped
+	now = now.Add(time.Hour)
+	l.allow("c")
+	assert.Equal(t, 1, l.len())
+}
+
+func ipContext(ip string) context.Context {
+	return context.WithValue(context.Background(), relayer.IP_CONTEXT_KEY, ip)
+}
+
+func TestRateLimitPolicy(t *testing.T) {
+	const (
+		pubkey       = "e6230af84359c4bedd38207a349dfbf8d25ad3b767518e7231fcae03907b9282"
+		otherPubkey  = "9be0be0e64d38a29a9cec9a5c8ef5d873c2bfa5362a4b558da5ff69bc3cbb81e"
+		freshPubkey  = "0b1e8bc9a6e0d8e9bc50c8e2a0a1cf82f7e6e1a5f3b1b9d4a2f2dc4e9d7e1f3a"
+		remotePubkey = "3f770d65d3a764a9c5cb503ae123e62ec7598ad035d836e2a810f3877a745b24"
+		exemptPubkey = "82f3b82c7f855340fc1905b20ac50b95d64c700d2b9546507415088e81535425"
+	)
+
+	policy := rateLimitPolicy{limits: newRateLimiters(RateLimitConfig{
+		Events: EventRateLimits{
+			Kinds: map[int]RateLimit{
+				1808: {Every: time.Hour, Burst: 1},
+				7:    {Every: time.Second, Burst: 3},
+			},
+		},
+		IPEvents: EventRateLimits{
+			Kinds: map[int]RateLimit{
+				1808: {Every: time.Hour, Burst: 2},
+			},
+		},
+		ExemptIPs: []string{"10.0.0.1"},
+	}, exemptPubkey)}
+
+	var tests = []struct {
+		name     string
+		ctx      context.Context
+		event    *nostr.Event
+		expected bool
+	}{
+		{
+			name:     "first track",
+			ctx:      ipContext("203.0.113.7"),
+			event:    &nostr.Event{PubKey: pubkey, Kind: 1808},
+			expected: true,
+		},
+		{
+			name:     "second track",
+			ctx:      ipContext("203.0.113.7"),
+			event:    &nostr.Event{PubKey: pubkey, Kind: 1808},
+			expected: false,
+		},
+		{
+			name:     "another pubkey from the same ip",
+			ctx:      ipContext("203.0.113.7"),
+			event:    &nostr.Event{PubKey: otherPubkey, Kind: 1808},
+			expected: true,
+		},
+		{
+			name:     "fresh pubkey from the same ip",
+			ctx:      ipContext("203.0.113.7"),
+			event:    &nostr.Event{PubKey: freshPubkey, Kind: 1808},
+			expected: false,
+		},
+		{
+			name:     "another ip",
+			ctx:      ipContext("198.51.100.1"),
+			event:    &nostr.Event{PubKey: remotePubkey, Kind: 1808},
+			expected: true,
+		},
+		{
+			name:     "admin",
+			ctx:      adminContext(context.Background()),
+			event:    &nostr.Event{PubKey: pubkey, Kind: 1808},
+			expected: true,
+		},
+		{
+			name:     "exempt pubkey",
+			ctx:      ipContext("203.0.113.7"),
+			event:    &nostr.Event{PubKey: exemptPubkey, Kind: 1808},
+			expected: true,
+		},
+		{
+			name:     "exempt pubkey again",
+			ctx:      ipContext("203.0.113.7"),
+			event:    &nostr.Event{PubKey: exemptPubkey, Kind: 1808},
+			expected: true,
+		},
+		{
+			name:     "reaction has its own bucket",
+			ctx:      ipContext("203.0.113.7"),
+			event:    &nostr.Event{PubKey: pubkey, Kind: 7},
+			expected: true,
+		},
+		{
+			name:     "kind without limit",
+			ctx:      ipContext("203.0.113.7"),
+			event:    &nostr.Event{PubKey: pubkey, Kind: 1},
+			expected: true,
+		},
+		{
+			name:     "unknown ip",
+			ctx:      context.Background(),
+			event:    &nostr.Event{PubKey: otherPubkey, Kind: 1063},
+			expected: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, reason := policy.Evaluate(tt.ctx, tt.event)
+			assert.Equal(t, tt.expected, ok)
+			if !ok {
+				assert.Equal(t, reasonRateLimited, reason)
+			}
+		})
+	}
+
+	// Exempt IPs are still limited per pubkey
+	for _, pubkey := range []string{"a", "b", "c"} {
+		assert.True(t, policy.limits.allowEvent(pubkey, "10.0.0.1", 1808))
+	}
+	assert.False(t, policy.limits.allowEvent("a", "10.0.0.1", 1808))
+
+	stats := policy.limits.stats()
+	assert.Equal(t, uint64(1), stats.IPEvents["1808"].Limited)
+	assert.Equal(t, []limitedKeyStats{{Key: "203.0.113.7", Limited: 1, LastUsed: stats.IPEvents["1808"].TopKeys[0].LastUsed}}, stats.IPEvents["1808"].TopKeys)
+}
+
+func TestIsWebsocketUpgrade(t *testing.T) {
+	var tests = []struct {
+		name     string
+		upgrade  []string
+		expected bool
+	}{
+		{
+			name:     "websocket",
+			upgrade:  []string{"websocket"},
+			expected: true,
+		},
+		{
+			name:     "mixed case",
+			upgrade:  []string{"WebSocket"},
+			expected: true,
+		},
+		{
+			name:     "token list",
+			upgrade:  []string{"h2c, WEBSOCKET"},
+			expected: true,
+		},
+		{
+			name:     "repeated header",
+			upgrade:  []string{"h2c", "websocket"},
+			expected: true,
+		},
+		{
+			name:     "other protocol",
+			upgrade:  []string{"h2c"},
+			expected: false,
+		},
+		{
+			name:     "no upgrade",
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for _, v := range tt.upgrade {
+				r.Header.Add("Upgrade", v)
+			}
+			assert.Equal(t, tt.expected, isWebsocketUpgrade(r))
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	var tests = []struct {
+		name              string
+		remoteAddr        string
+		forwardedFor      string
+		trustForwardedFor bool
+		expected          string
+	}{
+		{
+			name:       "remote addr",
+			remoteAddr: "203.0.113.7:51234",
+			expected:   "203.0.113.7",
+		},
+		{
+			name:         "forwarded for not trusted",
+			remoteAddr:   "10.0.0.2:51234",
+			forwardedFor: "198.51.100.1",
+			expected:     "10.0.0.2",
+		},
+		{
+			name:              "forwarded for",
+			remoteAddr:        "10.0.0.2:51234",
+			forwardedFor:      "198.51.100.1",
+			trustForwardedFor: true,
+			expected:          "198.51.100.1",
+		},
+		{
+			name:              "spoofed forwarded for",
+			remoteAddr:        "10.0.0.2:51234",
+			forwardedFor:      "1.2.3.4, 198.51.100.1",
+			trustForwardedFor: true,
+			expected:          "198.51.100.1",
+		},
+		{
+			name:              "missing forwarded for",
+			remoteAddr:        "10.0.0.2:51234",
+			trustForwardedFor: true,
+			expected:          "10.0.0.2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+
+			assert.Equal(t, tt.expected, clientIP(r, tt.trustForwardedFor))
+		})
+	}
+}
+
+func TestConnectionLimiter(t *testing.T) {
+	handler := connectionLimiter{
+		next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+		limits: newRateLimiters(RateLimitConfig{
+			Connections: RateLimit{Every: time.Hour, Burst: 1},
+			ExemptIPs:   []string{"10.0.0.1"},
+		}),
+	}
+
+	connect := func(remoteAddr string) int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("Upgrade", "websocket")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, connect("203.0.113.7:1234"))
+	assert.Equal(t, http.StatusTooManyRequests, connect("203.0.113.7:1235"))
+	assert.Equal(t, http.StatusOK, connect("10.0.0.1:1234"))
+	assert.Equal(t, http.StatusOK, connect("10.0.0.1:1235"))
+
+	// The Upgrade header isn't case sensitive
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "203.0.113.7:1236"
+	r.Header.Set("Upgrade", "WebSocket")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	// Plain HTTP requests aren't limited
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	stats := handler.limits.stats()
+	assert.Equal(t, uint64(1), stats.Connections.Allowed)
+	assert.Equal(t, uint64(2), stats.Connections.Limited)
+	assert.Equal(t, []limitedKeyStats{{Key: "203.0.113.7", Limited: 2, LastUsed: stats.Connections.TopKeys[0].LastUsed}}, stats.Connections.TopKeys)
+	assert.Equal(t, []string{"10.0.0.1"}, stats.ExemptIPs)
+}
+
+func TestAllowRead(t *testing.T) {
+	const pubkey = "e6230af84359c4bedd38207a349dfbf8d25ad3b767518e7231fcae03907b9282"
+
+	limits := newRateLimiters(RateLimitConfig{
+		Reads:     RateLimit{Every: time.Hour, Burst: 1},
+		ExemptIPs: []string{"10.0.0.1"},
+	}, pubkey)
+
+	assert.True(t, limits.allowRead(ipContext("203.0.113.7")))
+	assert.False(t, limits.allowRead(ipContext("203.0.113.7")))
+	// Authenticating as someone else doesn't get a new bucket
+	assert.False(t, limits.allowRead(context.WithValue(ipContext("203.0.113.7"), relayer.AUTH_CONTEXT_KEY, stemstrHexpub)))
+	assert.True(t, limits.allowRead(ipContext("198.51.100.1")))
+
+	// Exempt IPs and pubkeys, admin reads and reads without a connection
+	// aren't limited
+	for i := 0; i < 2; i++ {
+		assert.True(t, limits.allowRead(ipContext("10.0.0.1")))
+		assert.True(t, limits.allowRead(context.WithValue(ipContext("203.0.113.7"), relayer.AUTH_CONTEXT_KEY, pubkey)))
+		assert.True(t, limits.allowRead(adminContext(ipContext("203.0.113.7"))))
+		assert.True(t, limits.allowRead(context.Background()))
+	}
+}
+
+func TestReadRateLimitThroughServer(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	r := &authTestRelay{
+		store: &storage{limits: newRateLimiters(RateLimitConfig{
+			Reads: RateLimit{Every: time.Hour, Burst: 1},
+		})},
+	}
+	server, err := relayer.NewServer(r)
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	// read returns the next message other than AUTH and OK.
+	read := func() (label string, msg []json.RawMessage) {
+		for {
+			msg = nil
+			assert.NoError(t, conn.ReadJSON(&msg))
+			assert.NoError(t, json.Unmarshal(msg[0], &label))
+			if label != "AUTH" && label != "OK" {
+				return label, msg
+			}
+		}
+	}
+	publish := func(kind int) {
+		evt := nostr.Event{CreatedAt: nostr.Now(), Kind: kind, Tags: nostr.Tags{}}
+		assert.NoError(t, evt.Sign(sk))
+		assert.NoError(t, conn.WriteJSON([]any{"EVENT", evt}))
+	}
+
+	assert.NoError(t, conn.WriteJSON([]any{"REQ", "allowed", nostr.Filter{Kinds: []int{nostr.KindReaction}}}))
+	label, _ := read()
+	assert.Equal(t, "EOSE", label)
+
+	// The limited REQ is closed with the reason and gets no live events
+	assert.NoError(t, conn.WriteJSON([]any{"REQ", "limited", nostr.Filter{Kinds: []int{nostr.KindTextNote}}}))
+	label, msg := read()
+	assert.Equal(t, "CLOSED", label)
+	var id, reason string
+	assert.NoError(t, json.Unmarshal(msg[1], &id))
+	assert.NoError(t, json.Unmarshal(msg[2], &reason))
+	assert.Equal(t, "limited", id)
+	assert.Equal(t, reasonReadRateLimited, reason)
+
+	publish(nostr.KindTextNote)
+	publish(nostr.KindReaction)
+	label, msg = read()
+	assert.Equal(t, "EVENT", label)
+	assert.NoError(t, json.Unmarshal(msg[1], &id))
+	assert.Equal(t, "allowed", id)
+}
+
+func TestTrustedPubkeys(t *testing.T) {
+	pubkeys := trustedPubkeys(Config{
+		BlastrNsec: "nsec1kk96g7rj34yfnyyjmgcjwa7kvjvddngxy2lwfx357w4lj8fnc20qpl0cr6",
+	})
+
+	assert.Len(t, pubkeys, 2)
+	assert.Equal(t, stemstrHexpub, pubkeys[0])
+}
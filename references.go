@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const defaultReferenceCacheSize = 10000
+
+// referenceConfirmer confirms seen events filter hits against the event
+// table, so false positives don't let events reference missing events.
+type referenceConfirmer struct {
+	// existing returns which of ids are in the event table.
+	existing func(ids []string) (map[string]bool, error)
+	// confirmed caches ids known to be in the event table.
+	confirmed *lruSet
+
+	bloomHits      atomic.Uint64
+	cacheHits      atomic.Uint64
+	falsePositives atomic.Uint64
+}
+
+type referenceStats struct {
+	BloomHits      uint64 `json:"bloom_hits"`
+	CacheHits      uint64 `json:"cache_hits"`
+	FalsePositives uint64 `json:"false_positives"`
+	CacheSize      int    `json:"cache_size"`
+}
+
+func newReferenceConfirmer(s *storage, cacheSize int) *referenceConfirmer {
+	if cacheSize <= 0 {
+		cacheSize = defaultReferenceCacheSize
+	}
+
+	return &referenceConfirmer{
+		existing:  s.existingEventIDs,
+		confirmed: newLRUSet(cacheSize),
+	}
+}
+
+// confirm returns true if any of ids, all of which were reported by the
+// seen events filter, is really in the event table.
+func (c *referenceConfirmer) confirm(ids []string) bool {
+	c.bloomHits.Add(uint64(len(ids)))
+
+	for _, id := range ids {
+		if c.confirmed.contains(id) {
+			c.cacheHits.Add(1)
+			return true
+		}
+	}
+
+	existing, err := c.existing(ids)
+	if err != nil {
+		// Fall back to trusting the filter rather than rejecting
+		// legitimate events while the database is unhappy.
+		log.Printf("confirm references: %v\n", err)
+		return true
+	}
+
+	var found bool
+	for _, id := range ids {
+		if existing[id] {
+			c.confirmed.add(id)
+			found = true
+		} else {
+			c.falsePositives.Add(1)
+		}
+	}
+
+	return found
+}
+
+func (c *referenceConfirmer) stats() referenceStats {
+	return referenceStats{
+		BloomHits:      c.bloomHits.Load(),
+		CacheHits:      c.cacheHits.Load(),
+		FalsePositives: c.falsePositives.Load(),
+		CacheSize:      c.confirmed.len(),
+	}
+}
+
+// referencesKnownEvent returns true if event has an e tag to a seen event
+// that hasn't been deleted or moderated. Filter hits are confirmed against the event
+// table when configured.
+func (s *storage) referencesKnownEvent(event *nostr.Event) bool {
+	var hits []string
+	for _, tag := range event.Tags.GetAll([]string{"e"}) {
+		id := tag.Value()
+		if id != "" && s.seenEvents.Test([]byte(id)) && !s.tombstones.contains(id) && s.moderation.state(id) == "" {
+			hits = append(hits, id)
+		}
+	}
+	if len(hits) == 0 {
+		return false
+	}
+
+	if s.references == nil {
+		return true
+	}
+
+	return s.references.confirm(hits)
+}
+
+// existingEventIDs returns which of ids are in the event table.
+func (s *storage) existingEventIDs(ids []string) (map[string]bool, error) {
+	var found []string
+	if err := s.DB.Select(&found, "SELECT id FROM event WHERE id = ANY($1)", pq.Array(ids)); err != nil {
+		return nil, fmt.Errorf("select event ids: %w", err)
+	}
+
+	existing := make(map[string]bool, len(found))
+	for _, id := range found {
+		existing[id] = true
+	}
+
+	return existing, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReferencesKnownEventConfirmed(t *testing.T) {
+	f := newSeenFilter(1000, 0.01)
+	f.Add([]byte("12345"))
+	// Stands in for a bloom filter false positive
+	f.Add([]byte("falsepositive"))
+
+	var queries [][]string
+	var dbErr error
+	store := &storage{seenEvents: f}
+	store.references = &referenceConfirmer{
+		existing: func(ids []string) (map[string]bool, error) {
+			queries = append(queries, ids)
+			return map[string]bool{"12345": true}, dbErr
+		},
+		confirmed: newLRUSet(10),
+	}
+
+	var tests = []struct {
+		name            string
+		event           *nostr.Event
+		dbErr           error
+		expected        bool
+		expectedQueries int
+	}{
+		{
+			name:            "confirmed reference",
+			event:           &nostr.Event{Kind: 7, Tags: nostr.Tags{{"e", "12345"}}},
+			expected:        true,
+			expectedQueries: 1,
+		},
+		{
+			name:            "cached reference",
+			event:           &nostr.Event{Kind: 7, Tags: nostr.Tags{{"e", "12345"}}},
+			expected:        true,
+			expectedQueries: 1,
+		},
+		{
+			name:            "false positive",
+			event:           &nostr.Event{Kind: 7, Tags: nostr.Tags{{"e", "falsepositive"}}},
+			expected:        false,
+			expectedQueries: 2,
+		},
+		{
+			name:            "not in filter",
+			event:           &nostr.Event{Kind: 7, Tags: nostr.Tags{{"e", "yyy"}}},
+			expected:        false,
+			expectedQueries: 2,
+		},
+		{
+			name:            "database error trusts the filter",
+			event:           &nostr.Event{Kind: 7, Tags: nostr.Tags{{"e", "falsepositive"}}},
+			dbErr:           errors.New("db down"),
+			expected:        true,
+			expectedQueries: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbErr = tt.dbErr
+			assert.Equal(t, tt.expected, store.referencesKnownEvent(tt.event))
+			assert.Len(t, queries, tt.expectedQueries)
+		})
+	}
+
+	stats := store.references.stats()
+	assert.Equal(t, uint64(4), stats.BloomHits)
+	assert.Equal(t, uint64(1), stats.CacheHits)
+	assert.Equal(t, uint64(1), stats.FalsePositives)
+	assert.Equal(t, 1, stats.CacheSize)
+}
+
+func TestLRUSet(t *testing.T) {
+	s := newLRUSet(2)
+	s.add("a")
+	s.add("b")
+	assert.True(t, s.contains("a"))
+
+	// b is now the least recently used
+	s.add("c")
+	assert.False(t, s.contains("b"))
+	assert.True(t, s.contains("a"))
+	assert.True(t, s.contains("c"))
+
+	s.remove("a")
+	assert.False(t, s.contains("a"))
+	assert.Equal(t, 1, s.len())
+}
+
+func TestReferencesKnownEventTombstoned(t *testing.T) {
+	f := newSeenFilter(1000, 0.01)
+	f.Add([]byte("12345"))
+	f.Add([]byte("deleted"))
+
+	store := &storage{seenEvents: f, tombstones: newTombstones()}
+	store.tombstones.add("deleted")
+
+	assert.True(t, store.referencesKnownEvent(&nostr.Event{Kind: 7, Tags: nostr.Tags{{"e", "12345"}}}))
+	assert.False(t, store.referencesKnownEvent(&nostr.Event{Kind: 7, Tags: nostr.Tags{{"e", "deleted"}}}))
+	assert.True(t, store.referencesKnownEvent(&nostr.Event{Kind: 7, Tags: nostr.Tags{{"e", "deleted"}, {"e", "12345"}}}))
+}
+
+func TestTombstonesSet(t *testing.T) {
+	now := time.Unix(1690000000, 0)
+	ts := newTombstones()
+	ts.now = func() time.Time { return now }
+
+	ts.add("pruned")
+	now = now.Add(time.Minute)
+	since := now
+	// Added while the load was running, so it may be missing from it
+	ts.add("recent")
+
+	ts.set([]string{"loaded"}, since)
+	assert.False(t, ts.contains("pruned"))
+	assert.True(t, ts.contains("recent"))
+	assert.True(t, ts.contains("loaded"))
+	assert.Equal(t, 2, ts.len())
+}
@@ -5,21 +5,32 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/bits-and-blooms/bloom/v3"
 	"github.com/fiatjaf/relayer/v2"
 	"github.com/jmoiron/sqlx"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip11"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/rs/cors"
 	"golang.org/x/time/rate"
 )
 
 func newRelay(cfg Config, subscriptionsDB *sqlx.DB) (*Relay, error) {
+	if err := cfg.Auth.validate(); err != nil {
+		return nil, fmt.Errorf("auth: %w", err)
+	}
+
 	if len(cfg.AllowedKinds) == 0 {
 		cfg.AllowedKinds = defaultAllowedKinds
 	}
+	if len(cfg.SubscriptionKinds) == 0 {
+		cfg.SubscriptionKinds = subRequiredKinds
+	}
 
 	r := Relay{
 		cfg:     cfg,
@@ -27,10 +38,66 @@ func newRelay(cfg Config, subscriptionsDB *sqlx.DB) (*Relay, error) {
 		updates: make(chan nostr.Event),
 
 		subscriptionsDB: subscriptionsDB,
+		subscriptions:   newSubscriptionCache(subscriptionsDB, cfg.SubscriptionNegativeCacheTTL),
+
+		limits: newRateLimiters(cfg.RateLimits, trustedPubkeys(cfg)...),
 	}
 
+	if err := listenForSubscriptionChanges(cfg.SubscriptionsDBURL, r.subscriptions); err != nil {
+		// Lookups still work, changes are just picked up once cached
+		// entries expire.
+		log.Printf("listenForSubscriptionChanges: %v\n", err)
+	}
+
+	attestations, err := newAttestationVerifier(cfg.Attestation)
+	if err != nil {
+		return nil, fmt.Errorf("attestation: %w", err)
+	}
+
+	var nip05 *nip05Verifier
+	if len(cfg.Nip05Gate.Domains) > 0 {
+		nip05 = newNip05Verifier(cfg.Nip05Gate, r.storage.nip05Identifier)
+	}
+
+	var wot *webOfTrust
+	if len(cfg.WebOfTrust.Seeds) > 0 {
+		wot = newWebOfTrust(cfg.WebOfTrust, r.storage.contactLists)
+	}
+
+	policies, err := newPolicyPipeline(policyDeps{
+		cfg:           cfg,
+		storage:       r.storage,
+		subscriptions: r.subscriptions,
+		limits:        r.limits,
+		attestations:  attestations,
+		nip05:         nip05,
+		wot:           wot,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("policy pipeline: %w", err)
+	}
+	r.policies = policies
+	r.storage.accept = r.acceptEvent
+	r.storage.limits = r.limits
+	r.storage.wot = wot
+	r.storage.nip05 = nip05
+
+	if len(cfg.Auth.RequireForReadKinds) > 0 {
+		r.storage.readGate = &readGate{
+			kinds:        cfg.Auth.RequireForReadKinds,
+			isSubscribed: r.subscriptions.isSubscribed,
+		}
+	}
+
+	connection := cfg.RateLimits.Connection
+	if connection.Every <= 0 {
+		connection = defaultConnectionMessageRateLimit
+	}
 	opts := []relayer.Option{
-		relayer.WithPerConnectionLimiter(rate.Every(time.Millisecond*100), 10),
+		relayer.WithPerConnectionLimiter(rate.Every(connection.Every), connection.Burst),
+		relayer.WithClientIP(func(r *http.Request) string {
+			return clientIP(r, cfg.RateLimits.TrustForwardedFor)
+		}),
 	}
 	server, err := relayer.NewServer(r, opts...)
 	if err != nil {
@@ -47,7 +114,11 @@ type Relay struct {
 	storage *storage
 	updates chan nostr.Event
 
+	policies        policyPipeline
 	subscriptionsDB *sqlx.DB
+	subscriptions   *subscriptionCache
+
+	limits *rateLimiters
 }
 
 func (r *Relay) GetNIP11InformationDocument() nip11.RelayInformationDocument {
@@ -56,7 +127,7 @@ func (r *Relay) GetNIP11InformationDocument() nip11.RelayInformationDocument {
 		Description:   r.cfg.Nip11Description,
 		PubKey:        r.cfg.Nip11Pubkey,
 		Contact:       r.cfg.Nip11Contact,
-		SupportedNIPs: []int{9, 11, 12, 15, 16, 20, 45, 78, 94},
+		SupportedNIPs: []int{9, 11, 12, 15, 16, 20, 42, 45, 78, 94},
 		Software:      "https://github.com/Stemstr",
 		Version:       r.cfg.Nip11Version,
 	}
@@ -76,72 +147,76 @@ func (r Relay) Init() error {
 	return nil
 }
 
+// AcceptEvent can only answer with a bool, which the relayer turns into a
+// generic "blocked" OK message. Events that get stored are evaluated in
+// storage.SaveEvent instead, where a NIP-20 prefixed error is passed through
+// to the client as the OK reason. Ephemeral events are never saved so they
+// are evaluated here.
 func (r Relay) AcceptEvent(ctx context.Context, evt *nostr.Event) bool {
-	// Reject any kinds not explicitly allowed
-	allowed := false
-	for _, kind := range r.cfg.AllowedKinds {
-		if evt.Kind == kind {
-			allowed = true
-			break
-		}
-	}
-	if !allowed {
-		return false
+	if isEphemeralKind(evt.Kind) {
+		ok, _ := r.acceptEvent(ctx, evt)
+		return ok
 	}
 
-	// Reject events that are too large
-	jsonb, _ := json.Marshal(evt)
-	if len(jsonb) > 10000 {
-		log.Printf("rejected event, too large")
-		return false
-	}
-
-	// Require subscription for some events
-	if kindRequiresSubscription(evt.Kind) {
-		if ok, err := isSubscribed(r.subscriptionsDB, evt.PubKey); !ok {
-			if err != nil {
-				log.Printf("isSubscribed: %v\n", err)
-			}
-
-			log.Printf("rejected event, no sub. pubkey: %v", evt.PubKey)
-			return false
-		}
-	}
-
-	// Kind 1's must be from Stemstr client else reference a known event.
-	if evt.Kind == 1 {
-		if !fromStemstrClient(evt) && !referencesExistingEvent(r.storage.seenEvents, evt) {
-			log.Printf("rejected event, not from stemstr.app or referencing known event: %s", string(jsonb))
-			return false
-		}
-	}
-
-	// Reactions and reposts must reference a known event.
-	if evt.Kind == nostr.KindReaction || evt.Kind == 6 || evt.Kind == 16 {
-		if !referencesExistingEvent(r.storage.seenEvents, evt) {
-			fmt.Printf("rejected event, does not reference known event: %v\n", string(jsonb))
-			return false
-		}
-	}
+	return true
+}
 
-	// 1808s are only allowed from Stemstr client.
-	if evt.Kind == 1808 && !fromStemstrClient(evt) {
-		log.Printf("rejected event, not from stemstr.app: %s", string(jsonb))
-		return false
+// acceptEvent runs the policy pipeline, returning the NIP-20 reason on
+// rejection.
+func (r Relay) acceptEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
+	if ok, reason := r.policies.evaluate(ctx, evt); !ok {
+		return false, reason
 	}
 
+	jsonb, _ := json.Marshal(evt)
 	fmt.Printf("relay: received event: %v\n", string(jsonb))
 
-	return true
+	return true, ""
 }
 
 func (relay Relay) InjectEvents() chan nostr.Event {
 	return relay.updates
 }
 
+// Start serves the relay like relayer.Server.Start, adding the per IP
+// connection limit in front of it.
 func (r Relay) Start() error {
-	log.Printf("listening on 0.0.0.0:%v\n", r.cfg.Port)
-	return r.server.Start("0.0.0.0", r.cfg.Port)
+	addr := net.JoinHostPort("0.0.0.0", strconv.Itoa(r.cfg.Port))
+	handler := connectionLimiter{
+		next:              r.server,
+		limits:            r.limits,
+		access:            r.storage.access,
+		trustForwardedFor: r.cfg.RateLimits.TrustForwardedFor,
+	}
+	srv := &http.Server{
+		Handler:      cors.Default().Handler(handler),
+		Addr:         addr,
+		WriteTimeout: 2 * time.Second,
+		ReadTimeout:  2 * time.Second,
+		IdleTimeout:  30 * time.Second,
+	}
+
+	log.Printf("listening on %v\n", addr)
+	return srv.ListenAndServe()
+}
+
+// trustedPubkeys are our own accounts, which bypass rate limits: the
+// account credited in share notes and the blastr key.
+func trustedPubkeys(cfg Config) []string {
+	pubkeys := []string{stemstrHexpub}
+	if cfg.Share.AccountPubkey != "" {
+		pubkeys = append(pubkeys, cfg.Share.AccountPubkey)
+	}
+
+	if cfg.BlastrNsec != "" {
+		if _, sk, err := nip19.Decode(cfg.BlastrNsec); err == nil {
+			if pubkey, err := nostr.GetPublicKey(sk.(string)); err == nil {
+				pubkeys = append(pubkeys, pubkey)
+			}
+		}
+	}
+
+	return pubkeys
 }
 
 var defaultAllowedKinds = []int{
@@ -157,6 +232,10 @@ var defaultAllowedKinds = []int{
 	1063,  // NIP-94: File Metadata
 }
 
+func isEphemeralKind(kind int) bool {
+	return 20000 <= kind && kind < 30000
+}
+
 func fromStemstrClient(event *nostr.Event) bool {
 	clientTag := event.Tags.GetFirst([]string{"client"})
 	if clientTag == nil {
@@ -166,9 +245,14 @@ func fromStemstrClient(event *nostr.Event) bool {
 	return strings.EqualFold(clientTag.Value(), "stemstr.app")
 }
 
+// eventTester reports whether an event id may have been seen.
+type eventTester interface {
+	Test([]byte) bool
+}
+
 // referencesExistingEvent returns true if the given event has an e tag
 // to an event in the provided bloom filter.
-func referencesExistingEvent(f *bloom.BloomFilter, event *nostr.Event) bool {
+func referencesExistingEvent(f eventTester, event *nostr.Event) bool {
 	// Has no e tags, cannot reference existing event
 	eTags := event.Tags.GetAll([]string{"e"})
 	if eTags == nil || len(eTags) == 0 {
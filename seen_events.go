@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	defaultSeenEventsSnapshotInterval = 10 * time.Minute
+	// defaultSeenEventsSnapshotSlack is how far before the snapshot
+	// watermark events are rescanned on startup, to catch events that were
+	// being saved while the snapshot was taken.
+	defaultSeenEventsSnapshotSlack = time.Hour
+	// seenEventsBatchSize is how many event ids are fetched at a time when
+	// scanning the event table.
+	seenEventsBatchSize = 10000
+)
+
+var errNoSeenEventsSnapshot = errors.New("no seen events snapshot")
+
+// seenEventsSnapshot is a persisted copy of the seen events filter.
+// Watermark is the database's unix time when the snapshot was taken, so only
+// events inserted after it need to be added on startup. It is compared with
+// event.inserted_at rather than created_at, which clients set and may
+// backdate.
+type seenEventsSnapshot struct {
+	Watermark int64  `db:"watermark"`
+	Filter    []byte `db:"filter"`
+	Checksum  []byte `db:"checksum"`
+}
+
+func (s *storage) initSeenEventsSnapshotTable() error {
+	_, err := s.DB.Exec(`
+CREATE TABLE IF NOT EXISTS seen_events_snapshot (
+  id integer PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+  watermark bigint NOT NULL,
+  filter bytea NOT NULL,
+  checksum bytea NOT NULL,
+  created_at timestamptz NOT NULL DEFAULT NOW()
+);
+`)
+	if err != nil {
+		return err
+	}
+
+	return s.initEventInsertedAt()
+}
+
+// initEventInsertedAt adds the inserted_at column and index the snapshot
+// watermark is checked against. ALTER TABLE locks the event table even when
+// the column exists, so the catalog is checked first and the schema is only
+// changed once. The index is built concurrently, which can't run in a
+// transaction, so writes aren't blocked while it builds.
+func (s *storage) initEventInsertedAt() error {
+	var exists bool
+	err := s.DB.Get(&exists, `SELECT EXISTS (
+  SELECT 1 FROM information_schema.columns
+  WHERE table_schema = current_schema() AND table_name = 'event' AND column_name = 'inserted_at'
+)`)
+	if err != nil {
+		return fmt.Errorf("select inserted_at column: %w", err)
+	}
+	if !exists {
+		// NOW() is stable, so existing rows get it without a table rewrite
+		if _, err := s.DB.Exec("ALTER TABLE event ADD COLUMN IF NOT EXISTS inserted_at timestamptz NOT NULL DEFAULT NOW()"); err != nil {
+			return fmt.Errorf("add inserted_at column: %w", err)
+		}
+	}
+
+	// A concurrent build that failed leaves an invalid index behind, which
+	// is rebuilt rather than kept.
+	var valid bool
+	err = s.DB.Get(&valid, `SELECT EXISTS (
+  SELECT 1 FROM pg_index
+  WHERE indexrelid = to_regclass('event_inserted_at') AND indisvalid
+)`)
+	if err != nil {
+		return fmt.Errorf("select inserted_at index: %w", err)
+	}
+	if valid {
+		return nil
+	}
+
+	log.Printf("building event_inserted_at index\n")
+	if _, err := s.DB.Exec("DROP INDEX CONCURRENTLY IF EXISTS event_inserted_at"); err != nil {
+		return fmt.Errorf("drop inserted_at index: %w", err)
+	}
+	if _, err := s.DB.Exec("CREATE INDEX CONCURRENTLY IF NOT EXISTS event_inserted_at ON event (inserted_at)"); err != nil {
+		return fmt.Errorf("create inserted_at index: %w", err)
+	}
+
+	return nil
+}
+
+// initSeenEvents loads the seen events snapshot and adds events inserted
+// after its watermark. If the snapshot is missing, corrupt or was built with
+// different filter parameters, the filter is rebuilt from every event.
+func (s *storage) initSeenEvents() error {
+	var since int64
+
+	f, watermark, err := s.loadSeenEventsSnapshot()
+	switch {
+	case err != nil:
+		log.Printf("rebuilding seen events: %v\n", err)
+	case !f.compatible(s.cfg.BloomFilterSize, s.cfg.BloomFilterFP):
+		log.Printf("rebuilding seen events: snapshot filter parameters changed\n")
+	default:
+		s.seenEvents = f
+		since = watermark - int64(s.seenEventsSnapshotSlack().Seconds())
+		log.Printf("loaded seen events snapshot, watermark: %d\n", watermark)
+	}
+
+	count, err := s.scanEventIDs(since, func(id string) {
+		s.seenEvents.Add([]byte(id))
+	})
+	if err != nil {
+		return err
+	}
+
+	if s.cfg.SeenEventsWarnFP > 0 {
+		s.seenEvents.warnFP = s.cfg.SeenEventsWarnFP
+	}
+	if s.cfg.SeenEventsWarnFillRatio > 0 {
+		s.seenEvents.warnFillRatio = s.cfg.SeenEventsWarnFillRatio
+	}
+
+	log.Printf("seenFilter added: %d stats: %+v\n", count, s.seenEvents.stats())
+	return nil
+}
+
+func (s *storage) seenEventsSnapshotSlack() time.Duration {
+	if s.cfg.SeenEventsSnapshotSlack > 0 {
+		return s.cfg.SeenEventsSnapshotSlack
+	}
+
+	return defaultSeenEventsSnapshotSlack
+}
+
+// scanEventIDs streams the ids of events inserted at or after since, a unix
+// time, in batches through a server side cursor, calling fn for each of them.
+// Events saved before inserted_at existed count as inserted when it was
+// added, so the first startup after that rescans them all.
+func (s *storage) scanEventIDs(since int64, fn func(id string)) (int, error) {
+	tx, err := s.DB.Beginx()
+	if err != nil {
+		return 0, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DECLARE event_ids NO SCROLL CURSOR FOR SELECT id FROM event WHERE inserted_at >= to_timestamp($1)", since); err != nil {
+		return 0, fmt.Errorf("declare cursor: %w", err)
+	}
+
+	var count int
+	for {
+		var ids []string
+		if err := tx.Select(&ids, fmt.Sprintf("FETCH FORWARD %d FROM event_ids", seenEventsBatchSize)); err != nil && err != sql.ErrNoRows {
+			return count, fmt.Errorf("failed to fetch event ids: %w", err)
+		}
+
+		for _, id := range ids {
+			fn(id)
+		}
+		count += len(ids)
+
+		if len(ids) < seenEventsBatchSize {
+			break
+		}
+		log.Printf("seenFilter scanned %d events\n", count)
+	}
+
+	return count, nil
+}
+
+func (s *storage) loadSeenEventsSnapshot() (*seenFilter, int64, error) {
+	var snapshot seenEventsSnapshot
+	err := s.DB.Get(&snapshot, "SELECT watermark, filter, checksum FROM seen_events_snapshot WHERE id = 1")
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, 0, errNoSeenEventsSnapshot
+	} else if err != nil {
+		return nil, 0, fmt.Errorf("select snapshot: %w", err)
+	}
+
+	f, err := decodeSeenEvents(snapshot.Filter, snapshot.Checksum)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return f, snapshot.Watermark, nil
+}
+
+func (s *storage) saveSeenEventsSnapshot() error {
+	// Take the watermark first so events added while encoding are
+	// rescanned. It comes from the database so it compares with inserted_at
+	// whatever our clock says.
+	var watermark int64
+	if err := s.DB.Get(&watermark, "SELECT EXTRACT(EPOCH FROM NOW())::bigint"); err != nil {
+		return fmt.Errorf("select watermark: %w", err)
+	}
+
+	data, checksum, err := encodeSeenEvents(s.seenEvents)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.DB.Exec(`INSERT INTO seen_events_snapshot (id, watermark, filter, checksum, created_at)
+VALUES (1, $1, $2, $3, NOW())
+ON CONFLICT (id) DO UPDATE
+SET watermark = $1, filter = $2, checksum = $3, created_at = NOW()`,
+		watermark, data, checksum,
+	)
+	if err != nil {
+		return fmt.Errorf("save snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// snapshotSeenEvents periodically saves the seen events filter.
+func (s *storage) snapshotSeenEvents() {
+	interval := s.cfg.SeenEventsSnapshotInterval
+	if interval <= 0 {
+		interval = defaultSeenEventsSnapshotInterval
+	}
+
+	for range time.Tick(interval) {
+		if err := s.saveSeenEventsSnapshot(); err != nil {
+			log.Printf("saveSeenEventsSnapshot: %v\n", err)
+		}
+	}
+}
+
+func encodeSeenEvents(f *seenFilter) ([]byte, []byte, error) {
+	var buf bytes.Buffer
+	if err := f.encode(&buf); err != nil {
+		return nil, nil, fmt.Errorf("encode filter: %w", err)
+	}
+
+	checksum := sha256.Sum256(buf.Bytes())
+	return buf.Bytes(), checksum[:], nil
+}
+
+func decodeSeenEvents(data, checksum []byte) (*seenFilter, error) {
+	sum := sha256.Sum256(data)
+	if !bytes.Equal(sum[:], checksum) {
+		return nil, errors.New("snapshot checksum mismatch")
+	}
+
+	f, err := decodeSeenFilter(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decode filter: %w", err)
+	}
+
+	return f, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeenEventsSnapshotEncoding(t *testing.T) {
+	f := newSeenFilter(1000, 0.01)
+	f.Add([]byte("12345"))
+
+	data, checksum, err := encodeSeenEvents(f)
+	assert.NoError(t, err)
+
+	t.Run("roundtrip", func(t *testing.T) {
+		decoded, err := decodeSeenEvents(data, checksum)
+		assert.NoError(t, err)
+		assert.Equal(t, f.stats(), decoded.stats())
+		assert.True(t, decoded.Test([]byte("12345")))
+	})
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		corrupt := append([]byte{}, data...)
+		corrupt[len(corrupt)-1] ^= 0xff
+
+		_, err := decodeSeenEvents(corrupt, checksum)
+		assert.Error(t, err)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		truncated := data[:8]
+		sum := sha256.Sum256(truncated)
+
+		_, err := decodeSeenEvents(truncated, sum[:])
+		assert.Error(t, err)
+	})
+}
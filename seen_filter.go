@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/bits-and-blooms/bloom/v3"
+)
+
+const (
+	// seenFilterGrowth is how much larger each new layer is than the last.
+	seenFilterGrowth = 2
+	// seenFilterTightening is how much lower each new layer's false
+	// positive rate is than the last, keeping the overall rate bounded.
+	seenFilterTightening = 0.5
+
+	// A layer is about half full at capacity, so a fill ratio well above
+	// that means the filter is degrading.
+	defaultSeenEventsWarnFillRatio = 0.6
+
+	// seenFilterFormat identifies the encoding written by seenFilter.encode.
+	seenFilterFormat uint64 = 2
+)
+
+// seenFilter is a scalable bloom filter of seen event ids. Once the current
+// layer holds as many ids as it was sized for, a larger layer with a tighter
+// false positive rate is added instead of letting the rate climb.
+type seenFilter struct {
+	mu     sync.RWMutex
+	layers []*seenFilterLayer
+
+	// warnFP and warnFillRatio are the thresholds above which a warning is
+	// logged. warned tracks whether it already was for the current layer.
+	warnFP        float64
+	warnFillRatio float64
+	warned        bool
+}
+
+type seenFilterLayer struct {
+	filter   *bloom.BloomFilter
+	capacity uint
+	fp       float64
+	count    uint
+}
+
+type seenFilterStats struct {
+	Layers          int     `json:"layers"`
+	Count           uint    `json:"count"`
+	Capacity        uint    `json:"capacity"`
+	EstimatedFPRate float64 `json:"estimated_fp_rate"`
+	FillRatio       float64 `json:"fill_ratio"`
+}
+
+func newSeenFilter(capacity uint, fp float64) *seenFilter {
+	return &seenFilter{
+		layers:        []*seenFilterLayer{newSeenFilterLayer(capacity, fp)},
+		warnFP:        fp * 2,
+		warnFillRatio: defaultSeenEventsWarnFillRatio,
+	}
+}
+
+func newSeenFilterLayer(capacity uint, fp float64) *seenFilterLayer {
+	return &seenFilterLayer{
+		filter:   bloom.NewWithEstimates(capacity, fp),
+		capacity: capacity,
+		fp:       fp,
+	}
+}
+
+func (f *seenFilter) Add(id []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, layer := range f.layers {
+		if layer.filter.Test(id) {
+			// Already seen, or a false positive we can't tell apart.
+			// Either way adding it again would only fill the filter.
+			return
+		}
+	}
+
+	current := f.layers[len(f.layers)-1]
+	if current.count >= current.capacity {
+		next := newSeenFilterLayer(current.capacity*seenFilterGrowth, current.fp*seenFilterTightening)
+		f.layers = append(f.layers, next)
+		f.warned = false
+		log.Printf("seenFilter at capacity, added layer %d capacity: %d fp: %v\n", len(f.layers), next.capacity, next.fp)
+		current = next
+	}
+
+	current.filter.Add(id)
+	current.count++
+
+	f.checkThresholds()
+}
+
+func (f *seenFilter) Test(id []byte) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for _, layer := range f.layers {
+		if layer.filter.Test(id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkThresholds logs a warning once per layer when the estimated false
+// positive rate or the fill ratio pass their thresholds. f.mu must be held.
+func (f *seenFilter) checkThresholds() {
+	if f.warned {
+		return
+	}
+
+	current := f.layers[len(f.layers)-1]
+	// Counting set bits walks the whole bitset, so only check the fill
+	// ratio periodically.
+	if current.count%1000 != 0 {
+		return
+	}
+
+	fp := f.estimatedFPRate()
+	fill := current.fillRatio()
+	if fp > f.warnFP || fill > f.warnFillRatio {
+		log.Printf("[warn] seenFilter degrading, estimated fp rate: %v fill ratio: %v\n", fp, fill)
+		f.warned = true
+	}
+}
+
+// estimatedFPRate is the chance an id is in none of the layers but one of
+// them reports it anyway. f.mu must be held.
+func (f *seenFilter) estimatedFPRate() float64 {
+	none := 1.0
+	for _, layer := range f.layers {
+		none *= 1 - bloom.EstimateFalsePositiveRate(layer.filter.Cap(), layer.filter.K(), layer.count)
+	}
+
+	return 1 - none
+}
+
+func (l *seenFilterLayer) fillRatio() float64 {
+	return float64(l.filter.BitSet().Count()) / float64(l.filter.Cap())
+}
+
+// compatible reports whether f was created with the given parameters, i.e.
+// whether a snapshot of it can stand in for a new filter.
+func (f *seenFilter) compatible(capacity uint, fp float64) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	first := f.layers[0]
+	return first.capacity == capacity && first.fp == fp
+}
+
+func (f *seenFilter) stats() seenFilterStats {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	stats := seenFilterStats{
+		Layers:          len(f.layers),
+		EstimatedFPRate: f.estimatedFPRate(),
+		FillRatio:       f.layers[len(f.layers)-1].fillRatio(),
+	}
+	for _, layer := range f.layers {
+		stats.Count += layer.count
+		stats.Capacity += layer.capacity
+	}
+
+	return stats
+}
+
+// encode writes every layer along with its parameters.
+func (f *seenFilter) encode(w io.Writer) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for _, v := range []uint64{seenFilterFormat, uint64(len(f.layers))} {
+		if err := binary.Write(w, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	for _, layer := range f.layers {
+		header := []any{uint64(layer.capacity), layer.fp, uint64(layer.count)}
+		for _, v := range header {
+			if err := binary.Write(w, binary.BigEndian, v); err != nil {
+				return err
+			}
+		}
+		if _, err := layer.filter.WriteTo(w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decodeSeenFilter reads a filter written by seenFilter.encode.
+func decodeSeenFilter(r io.Reader) (*seenFilter, error) {
+	var format, numLayers uint64
+	if err := binary.Read(r, binary.BigEndian, &format); err != nil {
+		return nil, err
+	}
+	if format != seenFilterFormat {
+		return nil, fmt.Errorf("unknown seenFilter format %d", format)
+	}
+	if err := binary.Read(r, binary.BigEndian, &numLayers); err != nil {
+		return nil, err
+	}
+	if numLayers == 0 {
+		return nil, errors.New("seenFilter has no layers")
+	}
+
+	var layers []*seenFilterLayer
+	for i := uint64(0); i < numLayers; i++ {
+		var (
+			capacity, count uint64
+			fp              float64
+		)
+		for _, v := range []any{&capacity, &fp, &count} {
+			if err := binary.Read(r, binary.BigEndian, v); err != nil {
+				return nil, fmt.Errorf("layer %d header: %w", i, err)
+			}
+		}
+
+		var filter bloom.BloomFilter
+		if _, err := filter.ReadFrom(r); err != nil {
+			return nil, fmt.Errorf("layer %d filter: %w", i, err)
+		}
+
+		layers = append(layers, &seenFilterLayer{
+			filter:   &filter,
+			capacity: uint(capacity),
+			fp:       fp,
+			count:    uint(count),
+		})
+	}
+
+	f := newSeenFilter(layers[0].capacity, layers[0].fp)
+	f.layers = layers
+	return f, nil
+}
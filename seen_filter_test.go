@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeenFilterAddsLayersAtCapacity(t *testing.T) {
+	f := newSeenFilter(100, 0.01)
+
+	for i := 0; i < 1000; i++ {
+		f.Add([]byte(fmt.Sprintf("event-%d", i)))
+	}
+
+	stats := f.stats()
+	// 100 + 200 + 400 + 800
+	assert.Equal(t, 4, stats.Layers)
+	assert.Equal(t, uint(1500), stats.Capacity)
+	// Ids reported as already seen are not added again
+	assert.LessOrEqual(t, stats.Count, uint(1000))
+	assert.Greater(t, stats.Count, uint(950))
+
+	// Every layer stays within its false positive rate, so the overall rate
+	// stays near the target instead of climbing with the event count.
+	assert.Less(t, stats.EstimatedFPRate, 0.02)
+	assert.Greater(t, stats.FillRatio, 0.0)
+	assert.Less(t, stats.FillRatio, 0.6)
+
+	for i := 0; i < 1000; i++ {
+		assert.True(t, f.Test([]byte(fmt.Sprintf("event-%d", i))))
+	}
+}
+
+func TestSeenFilterEncoding(t *testing.T) {
+	f := newSeenFilter(10, 0.01)
+	for i := 0; i < 25; i++ {
+		f.Add([]byte(fmt.Sprintf("event-%d", i)))
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, f.encode(&buf))
+
+	decoded, err := decodeSeenFilter(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, f.stats(), decoded.stats())
+	assert.True(t, decoded.compatible(10, 0.01))
+	assert.False(t, decoded.compatible(1000, 0.01))
+	assert.True(t, decoded.Test([]byte("event-24")))
+
+	_, err = decodeSeenFilter(bytes.NewReader([]byte("not a filter at all")))
+	assert.Error(t, err)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"text/template"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+const (
+	stemstrNpub   = "npub1stemstrls4f5plqeqkeq43gtjhtycuqd9w25v5r5z5ygaq2n2sjsd6mul5"
+	stemstrHexpub = "82f3b82c7f855340fc1905b20ac50b95d64c700d2b9546507415088e81535425"
+)
+
+// defaultShareTemplate is the share note posted when none are configured.
+var defaultShareTemplate = ShareTemplate{
+	Name:    "default",
+	Content: "🎉 Let's gooo! nostr:{{ .Npub }} just shared a track on nostr:{{ .AccountNpub }} 🙌.\n\nCheck it out at https://stemstr.app/thread/{{ .Event.ID }}/\n\n#stemstr #music #tunestr",
+	Tags: [][]string{
+		{"p", "{{ .Event.PubKey }}"},  // Tag author
+		{"p", "{{ .AccountPubkey }}"}, // Tag stemstr
+		{"t", "stemstr"},
+		{"t", "music"},
+		{"t", "tunestr"},
+	},
+}
+
+// shareData is what share templates are executed with.
+type shareData struct {
+	Event *nostr.Event
+	// Npub is the event author's npub.
+	Npub string
+	// Tags holds the first value of each of the event's tags by name, e.g.
+	// {{ .Tags.title }}.
+	Tags map[string]string
+	// AccountPubkey and AccountNpub are the account credited in the note.
+	AccountPubkey string
+	AccountNpub   string
+}
+
+type shareTemplate struct {
+	name    string
+	match   map[string]string
+	content *template.Template
+	tags    [][]*template.Template
+}
+
+// shareTemplates renders share notes from the configured templates.
+type shareTemplates struct {
+	templates     []*shareTemplate
+	accountPubkey string
+	accountNpub   string
+	// pick returns a random index below n.
+	pick func(n int) int
+}
+
+func newShareTemplates(cfg ShareConfig) (*shareTemplates, error) {
+	configured := cfg.Templates
+	if len(configured) == 0 {
+		configured = []ShareTemplate{defaultShareTemplate}
+	}
+
+	s := &shareTemplates{
+		accountPubkey: cfg.AccountPubkey,
+		pick:          rand.Intn,
+	}
+	if s.accountPubkey == "" {
+		s.accountPubkey = stemstrHexpub
+	}
+
+	npub, err := nip19.EncodePublicKey(s.accountPubkey)
+	if err != nil {
+		return nil, fmt.Errorf("share account pubkey: %w", err)
+	}
+	s.accountNpub = npub
+
+	names := make(map[string]bool)
+	for i, c := range configured {
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("template-%d", i)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("duplicate share template %q", c.Name)
+		}
+		names[c.Name] = true
+
+		t, err := parseShareTemplate(c)
+		if err != nil {
+			return nil, fmt.Errorf("share template %q: %w", c.Name, err)
+		}
+		s.templates = append(s.templates, t)
+	}
+
+	return s, nil
+}
+
+func parseShareTemplate(c ShareTemplate) (*shareTemplate, error) {
+	content, err := template.New("content").Option("missingkey=zero").Parse(c.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &shareTemplate{
+		name:    c.Name,
+		match:   c.Match,
+		content: content,
+	}
+	for i, tag := range c.Tags {
+		var parsed []*template.Template
+		for j, value := range tag {
+			vt, err := template.New(fmt.Sprintf("tag %d.%d", i, j)).Option("missingkey=zero").Parse(value)
+			if err != nil {
+				return nil, err
+			}
+			parsed = append(parsed, vt)
+		}
+		t.tags = append(t.tags, parsed)
+	}
+
+	return t, nil
+}
+
+// matches reports whether every tag in t.match has the given value on evt.
+func (t *shareTemplate) matches(evt *nostr.Event) bool {
+	for name, value := range t.match {
+		if !hasTag(evt, name, value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func hasTag(evt *nostr.Event, name, value string) bool {
+	for _, tag := range evt.Tags {
+		if len(tag) >= 2 && tag[0] == name && tag[1] == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// choose picks a template for evt. Templates whose match rules the event
+// satisfies win over those without rules; ties are broken at random.
+func (s *shareTemplates) choose(evt *nostr.Event) *shareTemplate {
+	var matched, fallback []*shareTemplate
+	for _, t := range s.templates {
+		switch {
+		case len(t.match) == 0:
+			fallback = append(fallback, t)
+		case t.matches(evt):
+			matched = append(matched, t)
+		}
+	}
+
+	candidates := matched
+	if len(candidates) == 0 {
+		candidates = fallback
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	return candidates[s.pick(len(candidates))]
+}
+
+// byName returns the template called name, or nil.
+func (s *shareTemplates) byName(name string) *shareTemplate {
+	for _, t := range s.templates {
+		if t.name == name {
+			return t
+		}
+	}
+
+	return nil
+}
+
+// generate renders the share note for evt with a chosen template. It
+// returns nil if no template applies or rendering fails.
+func (s *shareTemplates) generate(evt *nostr.Event) *nostr.Event {
+	t := s.choose(evt)
+	if t == nil {
+		return nil
+	}
+
+	return s.render(t, evt)
+}
+
+func (s *shareTemplates) render(t *shareTemplate, evt *nostr.Event) *nostr.Event {
+	npub, err := nip19.EncodePublicKey(evt.PubKey)
+	if err != nil {
+		log.Printf("failed to encoded share event npub: %v", err)
+		return nil
+	}
+
+	data := shareData{
+		Event:         evt,
+		Npub:          npub,
+		Tags:          make(map[string]string),
+		AccountPubkey: s.accountPubkey,
+		AccountNpub:   s.accountNpub,
+	}
+	for _, tag := range evt.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		if _, ok := data.Tags[tag[0]]; !ok {
+			data.Tags[tag[0]] = tag[1]
+		}
+	}
+
+	content, err := executeShareTemplate(t.content, data)
+	if err != nil {
+		log.Printf("[error] share template %q content: %v\n", t.name, err)
+		return nil
+	}
+
+	tags := nostr.Tags{}
+	for _, parsed := range t.tags {
+		var tag nostr.Tag
+		for _, vt := range parsed {
+			value, err := executeShareTemplate(vt, data)
+			if err != nil {
+				log.Printf("[error] share template %q tags: %v\n", t.name, err)
+				return nil
+			}
+			tag = append(tag, value)
+		}
+		// Drop tags whose values rendered empty, e.g. a genre the event
+		// doesn't have.
+		if len(tag) < 2 || tag[1] == "" {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+
+	return &nostr.Event{
+		Kind:    nostr.KindTextNote,
+		Tags:    tags,
+		Content: content,
+	}
+}
+
+func executeShareTemplate(t *template.Template, data shareData) (string, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
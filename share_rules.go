@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// defaultShareRules announces every track when no rules are configured.
+var defaultShareRules = []ShareRule{
+	{Name: "tracks", Kinds: []int{1808}},
+}
+
+type shareRule struct {
+	ShareRule
+	authors  map[string]bool
+	template *shareTemplate
+}
+
+// shareRules decides which saved events are announced and renders the
+// announcement with the rule's template.
+type shareRules struct {
+	rules     []*shareRule
+	templates *shareTemplates
+	// firstFromAuthor reports whether evt is its author's first event of
+	// its kind.
+	firstFromAuthor func(evt *nostr.Event) (bool, error)
+	now             func() time.Time
+
+	mu sync.Mutex
+	// throttledUntil is when a rule may trigger for an author again, keyed
+	// by rule name and pubkey.
+	throttledUntil map[string]time.Time
+}
+
+func newShareRules(cfg ShareConfig, firstFromAuthor func(*nostr.Event) (bool, error)) (*shareRules, error) {
+	templates, err := newShareTemplates(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	configured := cfg.Rules
+	if len(configured) == 0 {
+		configured = defaultShareRules
+	}
+
+	s := &shareRules{
+		templates:       templates,
+		firstFromAuthor: firstFromAuthor,
+		now:             time.Now,
+		throttledUntil:  make(map[string]time.Time),
+	}
+
+	names := make(map[string]bool)
+	for i, c := range configured {
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("duplicate share rule %q", c.Name)
+		}
+		names[c.Name] = true
+
+		rule := &shareRule{ShareRule: c}
+		if c.Template != "" {
+			if rule.template = templates.byName(c.Template); rule.template == nil {
+				return nil, fmt.Errorf("share rule %q: unknown template %q", c.Name, c.Template)
+			}
+		}
+		if len(c.Authors) > 0 {
+			rule.authors = make(map[string]bool)
+			for _, pubkey := range c.Authors {
+				rule.authors[pubkey] = true
+			}
+		}
+		if c.FirstFromAuthor && firstFromAuthor == nil {
+			return nil, fmt.Errorf("share rule %q: first_from_author is not available", c.Name)
+		}
+
+		s.rules = append(s.rules, rule)
+	}
+
+	return s, nil
+}
+
+// matches reports whether evt satisfies every condition of the rule.
+func (r *shareRule) matches(evt *nostr.Event, firstFromAuthor func(*nostr.Event) (bool, error)) bool {
+	if len(r.Kinds) > 0 && !containsInt(r.Kinds, evt.Kind) {
+		return false
+	}
+	for name, value := range r.Tags {
+		if !hasTag(evt, name, value) {
+			return false
+		}
+	}
+	if r.authors != nil && !r.authors[evt.PubKey] {
+		return false
+	}
+	if r.Reply && evt.Tags.GetFirst([]string{"e", ""}) == nil {
+		return false
+	}
+
+	// Checked last as it queries the database
+	if r.FirstFromAuthor {
+		first, err := firstFromAuthor(evt)
+		if err != nil {
+			log.Printf("[error] share rule %q first from author: %v\n", r.Name, err)
+			return false
+		}
+		if !first {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsInt(ints []int, i int) bool {
+	for _, v := range ints {
+		if v == i {
+			return true
+		}
+	}
+
+	return false
+}
+
+// match returns the first rule evt satisfies, recording the share. It
+// returns nil if none do or if that rule's author throttle hasn't passed;
+// later rules aren't tried, so a throttled event isn't announced by a more
+// general rule instead.
+func (s *shareRules) match(evt *nostr.Event) *shareRule {
+	for _, rule := range s.rules {
+		if !rule.matches(evt, s.firstFromAuthor) {
+			continue
+		}
+		if s.throttled(rule, evt.PubKey) {
+			log.Printf("share rule %q throttled for %s\n", rule.Name, evt.PubKey)
+			return nil
+		}
+
+		return rule
+	}
+
+	return nil
+}
+
+// throttled reports whether rule triggered for pubkey within its throttle,
+// and otherwise records that it triggers now.
+func (s *shareRules) throttled(rule *shareRule, pubkey string) bool {
+	if rule.Throttle <= 0 {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	key := rule.Name + ":" + pubkey
+	if until, ok := s.throttledUntil[key]; ok && now.Before(until) {
+		return true
+	}
+	s.throttledUntil[key] = now.Add(rule.Throttle)
+
+	// Forget expired throttles so the map doesn't grow with every author
+	// ever seen.
+	if len(s.throttledUntil) > 10000 {
+		for k, until := range s.throttledUntil {
+			if !now.Before(until) {
+				delete(s.throttledUntil, k)
+			}
+		}
+	}
+
+	return false
+}
+
+// shareEvent returns the announcement for evt, or nil if no rule triggers.
+func (s *shareRules) shareEvent(evt *nostr.Event) *nostr.Event {
+	rule := s.match(evt)
+	if rule == nil {
+		return nil
+	}
+
+	if rule.template != nil {
+		return s.templates.render(rule.template, evt)
+	}
+
+	return s.templates.generate(evt)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShareRules(t *testing.T) {
+	const (
+		artistPubkey = "e6230af84359c4bedd38207a349dfbf8d25ad3b767518e7231fcae03907b9282"
+		otherPubkey  = "82f3b82c7f855340fc1905b20ac50b95d64c700d2b9546507415088e81535425"
+	)
+
+	cfg := ShareConfig{
+		Templates: []ShareTemplate{
+			{Name: "first", Content: "first"},
+			{Name: "remix", Content: "remix"},
+			{Name: "reply", Content: "reply"},
+		},
+		Rules: []ShareRule{
+			{Name: "first track", Kinds: []int{1808}, FirstFromAuthor: true, Template: "first"},
+			{Name: "remix", Kinds: []int{1808}, Tags: map[string]string{"t": "remix"}, Template: "remix", Throttle: time.Hour},
+			{Name: "artist reply", Kinds: []int{1}, Reply: true, Authors: []string{artistPubkey}, Template: "reply"},
+		},
+	}
+
+	var tests = []struct {
+		name            string
+		event           *nostr.Event
+		first           bool
+		firstErr        error
+		expectedContent string
+	}{
+		{
+			name:            "first track from author",
+			event:           &nostr.Event{PubKey: otherPubkey, Kind: 1808},
+			first:           true,
+			expectedContent: "first",
+		},
+		{
+			name:  "not the first track",
+			event: &nostr.Event{PubKey: otherPubkey, Kind: 1808},
+		},
+		{
+			name:     "first check failing",
+			event:    &nostr.Event{PubKey: otherPubkey, Kind: 1808},
+			firstErr: errors.New("db down"),
+		},
+		{
+			name:            "remix",
+			event:           &nostr.Event{PubKey: otherPubkey, Kind: 1808, Tags: nostr.Tags{{"t", "remix"}}},
+			expectedContent: "remix",
+		},
+		{
+			name:            "first remix matches the first rule",
+			event:           &nostr.Event{PubKey: otherPubkey, Kind: 1808, Tags: nostr.Tags{{"t", "remix"}}},
+			first:           true,
+			expectedContent: "first",
+		},
+		{
+			name:            "reply from artist",
+			event:           &nostr.Event{PubKey: artistPubkey, Kind: 1, Tags: nostr.Tags{{"e", "12345"}}},
+			expectedContent: "reply",
+		},
+		{
+			name:  "reply from someone else",
+			event: &nostr.Event{PubKey: otherPubkey, Kind: 1, Tags: nostr.Tags{{"e", "12345"}}},
+		},
+		{
+			name:  "artist note that isn't a reply",
+			event: &nostr.Event{PubKey: artistPubkey, Kind: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := newShareRules(cfg, func(*nostr.Event) (bool, error) {
+				return tt.first, tt.firstErr
+			})
+			assert.NoError(t, err)
+
+			shareEvent := rules.shareEvent(tt.event)
+			if tt.expectedContent == "" {
+				assert.Nil(t, shareEvent)
+			} else if assert.NotNil(t, shareEvent) {
+				assert.Equal(t, tt.expectedContent, shareEvent.Content)
+			}
+		})
+	}
+}
+
+func TestShareRulesThrottle(t *testing.T) {
+	const (
+		pubkey      = "e6230af84359c4bedd38207a349dfbf8d25ad3b767518e7231fcae03907b9282"
+		otherPubkey = "82f3b82c7f855340fc1905b20ac50b95d64c700d2b9546507415088e81535425"
+	)
+
+	rules, err := newShareRules(ShareConfig{
+		Rules: []ShareRule{{Name: "tracks", Kinds: []int{1808}, Throttle: time.Hour}},
+	}, nil)
+	assert.NoError(t, err)
+
+	now := time.Unix(1690000000, 0)
+	rules.now = func() time.Time { return now }
+
+	track := &nostr.Event{PubKey: pubkey, Kind: 1808}
+	assert.NotNil(t, rules.shareEvent(track))
+	// Ten stems uploaded at once only announce the first
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, rules.shareEvent(track))
+	}
+	// Other authors aren't throttled
+	assert.NotNil(t, rules.shareEvent(&nostr.Event{PubKey: otherPubkey, Kind: 1808}))
+
+	now = now.Add(time.Hour)
+	assert.NotNil(t, rules.shareEvent(track))
+}
+
+func TestShareRulesThrottleStopsMatching(t *testing.T) {
+	const pubkey = "e6230af84359c4bedd38207a349dfbf8d25ad3b767518e7231fcae03907b9282"
+
+	rules, err := newShareRules(ShareConfig{
+		Rules: []ShareRule{
+			{Name: "remix", Kinds: []int{1808}, Tags: map[string]string{"t": "remix"}, Throttle: time.Hour},
+			{Name: "tracks", Kinds: []int{1808}},
+		},
+	}, nil)
+	assert.NoError(t, err)
+
+	now := time.Unix(1690000000, 0)
+	rules.now = func() time.Time { return now }
+
+	remix := &nostr.Event{PubKey: pubkey, Kind: 1808, Tags: nostr.Tags{{"t", "remix"}}}
+	assert.Equal(t, "remix", rules.match(remix).Name)
+	// A throttled remix isn't announced by the general rule instead
+	assert.Nil(t, rules.match(remix))
+	// Tracks the throttled rule doesn't match still are
+	assert.Equal(t, "tracks", rules.match(&nostr.Event{PubKey: pubkey, Kind: 1808}).Name)
+}
+
+func TestNewShareRulesInvalid(t *testing.T) {
+	var tests = []struct {
+		name string
+		cfg  ShareConfig
+	}{
+		{
+			name: "unknown template",
+			cfg:  ShareConfig{Rules: []ShareRule{{Template: "missing"}}},
+		},
+		{
+			name: "duplicate names",
+			cfg:  ShareConfig{Rules: []ShareRule{{Name: "a"}, {Name: "a"}}},
+		},
+		{
+			name: "first from author without history",
+			cfg:  ShareConfig{Rules: []ShareRule{{FirstFromAuthor: true}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newShareRules(tt.cfg, nil)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShareTemplates(t *testing.T) {
+	const authorPubkey = "e6230af84359c4bedd38207a349dfbf8d25ad3b767518e7231fcae03907b9282"
+
+	cfg := ShareConfig{
+		Templates: []ShareTemplate{
+			{
+				Name:    "plain",
+				Content: "{{ .Tags.title }} by {{ .Npub }}",
+				Tags: [][]string{
+					{"p", "{{ .Event.PubKey }}"},
+					{"t", "{{ .Tags.genre }}"},
+				},
+			},
+			{
+				Name:    "hype",
+				Content: "new track: {{ .Tags.title }}",
+			},
+			{
+				Name:    "remix",
+				Match:   map[string]string{"t": "remix"},
+				Content: "{{ .Tags.title }} is a remix, thanks nostr:{{ .AccountNpub }}",
+			},
+		},
+	}
+
+	var tests = []struct {
+		name            string
+		event           *nostr.Event
+		pick            int
+		expectedContent string
+		expectedTags    nostr.Tags
+	}{
+		{
+			name: "renders event tags and drops empty ones",
+			event: &nostr.Event{
+				PubKey: authorPubkey,
+				Kind:   1808,
+				Tags:   nostr.Tags{{"title", "sunrise"}},
+			},
+			pick:            0,
+			expectedContent: "sunrise by npub1uc3s47zrt8ztahfcyparf80mlrf945ahvagcuu33ljhq8yrmj2pqefmzr7",
+			expectedTags:    nostr.Tags{{"p", authorPubkey}},
+		},
+		{
+			name: "renders present optional tags",
+			event: &nostr.Event{
+				PubKey: authorPubkey,
+				Kind:   1808,
+				Tags:   nostr.Tags{{"title", "sunrise"}, {"genre", "house"}},
+			},
+			pick:            0,
+			expectedContent: "sunrise by npub1uc3s47zrt8ztahfcyparf80mlrf945ahvagcuu33ljhq8yrmj2pqefmzr7",
+			expectedTags:    nostr.Tags{{"p", authorPubkey}, {"t", "house"}},
+		},
+		{
+			name: "picks among unconditional templates",
+			event: &nostr.Event{
+				PubKey: authorPubkey,
+				Kind:   1808,
+				Tags:   nostr.Tags{{"title", "sunrise"}},
+			},
+			pick:            1,
+			expectedContent: "new track: sunrise",
+			expectedTags:    nostr.Tags{},
+		},
+		{
+			name: "prefers matching template",
+			event: &nostr.Event{
+				PubKey: authorPubkey,
+				Kind:   1808,
+				Tags:   nostr.Tags{{"title", "sunrise"}, {"t", "remix"}},
+			},
+			pick:            0,
+			expectedContent: "sunrise is a remix, thanks nostr:" + stemstrNpub,
+			expectedTags:    nostr.Tags{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shares, err := newShareTemplates(cfg)
+			assert.NoError(t, err)
+			shares.pick = func(n int) int { return tt.pick }
+
+			shareEvent := shares.generate(tt.event)
+			if assert.NotNil(t, shareEvent) {
+				assert.Equal(t, nostr.KindTextNote, shareEvent.Kind)
+				assert.Equal(t, tt.expectedContent, shareEvent.Content)
+				assert.Equal(t, tt.expectedTags, shareEvent.Tags)
+			}
+		})
+	}
+}
+
+func TestNewShareTemplatesInvalid(t *testing.T) {
+	var tests = []struct {
+		name string
+		cfg  ShareConfig
+	}{
+		{
+			name: "bad syntax",
+			cfg:  ShareConfig{Templates: []ShareTemplate{{Content: "{{ .Npub "}}},
+		},
+		{
+			name: "duplicate names",
+			cfg:  ShareConfig{Templates: []ShareTemplate{{Name: "a"}, {Name: "a"}}},
+		},
+		{
+			name: "bad account pubkey",
+			cfg:  ShareConfig{AccountPubkey: "nothex"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newShareTemplates(tt.cfg)
+			assert.Error(t, err)
+		})
+	}
+}
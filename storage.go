@@ -2,14 +2,13 @@ package main
 
 import (
 	"context"
-	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
 
-	"github.com/bits-and-blooms/bloom/v3"
 	"github.com/fiatjaf/relayer/v2/storage/postgresql"
 	"github.com/nbd-wtf/go-nostr"
-	"github.com/nbd-wtf/go-nostr/nip19"
 	"github.com/stemstr/blastr"
 )
 
@@ -26,6 +25,10 @@ func newStorage(cfg Config) *storage {
 		cfg: cfg,
 	}
 
+	if cfg.ConfirmReferences {
+		store.references = newReferenceConfirmer(store, cfg.ReferenceCacheSize)
+	}
+
 	if cfg.BlastrNsec != "" {
 		store.blastr, _ = blastr.New(cfg.BlastrNsec)
 	}
@@ -35,9 +38,37 @@ func newStorage(cfg Config) *storage {
 
 type storage struct {
 	*postgresql.PostgresBackend
-	cfg        Config
-	blastr     blastrIface
-	seenEvents *bloom.BloomFilter
+	cfg    Config
+	blastr blastrIface
+	// shares decides which events are announced and renders the notes.
+	shares *shareRules
+	// outbox, if set, queues share events for blastr with retries.
+	outbox     *outbox
+	seenEvents *seenFilter
+	// references, if set, confirms seenEvents hits against the event table.
+	references *referenceConfirmer
+	// tombstones are deleted event ids still in seenEvents.
+	tombstones *tombstones
+
+	// accept is called before saving an event. A rejection reason is returned
+	// as the SaveEvent error so it reaches the client in the OK message.
+	accept func(context.Context, *nostr.Event) (bool, string)
+	// readGate, if set, hides restricted kinds from unauthorized readers,
+	// through the conditions it adds to every query and count.
+	readGate *readGate
+	// limits, if set, rate limits reads.
+	limits *rateLimiters
+	// wot, if set, is kept up to date with saved contact lists.
+	wot *webOfTrust
+	// nip05, if set, reverifies authors who save new metadata.
+	nip05 *nip05Verifier
+	// access holds the block and allow lists.
+	access *accessList
+	// moderation hides moderated events from everyone but admins, through
+	// the conditions it adds to every query and count.
+	moderation *moderation
+	// audit records admin actions.
+	audit *auditLog
 }
 
 type blastrIface interface {
@@ -53,87 +84,187 @@ func (s *storage) Init() error {
 	// Now do our own init
 	if s.cfg.BloomFilterSize > 0 && s.cfg.BloomFilterFP > 0 {
 		log.Printf("bloom filter size: %v fp: %v\n", s.cfg.BloomFilterSize, s.cfg.BloomFilterFP)
-		s.seenEvents = bloom.NewWithEstimates(s.cfg.BloomFilterSize, s.cfg.BloomFilterFP)
 	} else {
 		log.Printf("defaulting bloom filter size: 1,000,000 fp: 0.01\n")
-		s.seenEvents = bloom.NewWithEstimates(1_000_000, 0.01)
+		s.cfg.BloomFilterSize = 1_000_000
+		s.cfg.BloomFilterFP = 0.01
+	}
+	s.seenEvents = newSeenFilter(s.cfg.BloomFilterSize, s.cfg.BloomFilterFP)
+
+	if err := s.initSeenEventsSnapshotTable(); err != nil {
+		return fmt.Errorf("initSeenEventsSnapshotTable: %w", err)
 	}
 
 	if err := s.initSeenEvents(); err != nil {
 		return fmt.Errorf("initSeenEvents: %w", err)
 	}
 
+	if err := s.initTombstones(); err != nil {
+		return fmt.Errorf("initTombstones: %w", err)
+	}
+	go s.refreshTombstones()
+
+	access, err := newAccessList(s.DB)
+	if err != nil {
+		return fmt.Errorf("newAccessList: %w", err)
+	}
+	s.access = access
+	go s.access.refresh()
+
+	m, err := newModeration(s.DB)
+	if err != nil {
+		return fmt.Errorf("newModeration: %w", err)
+	}
+	s.moderation = m
+	s.PostgresBackend.Conditions = s.conditions
+	go s.moderation.refresh()
+
+	audit, err := newAuditLog(s.DB)
+	if err != nil {
+		return fmt.Errorf("newAuditLog: %w", err)
+	}
+	s.audit = audit
+
+	if s.blastr != nil {
+		shares, err := newShareRules(s.cfg.Share, s.firstFromAuthor)
+		if err != nil {
+			return fmt.Errorf("newShareRules: %w", err)
+		}
+		s.shares = shares
+
+		o, err := newOutbox(s.DB, s.blastr)
+		if err != nil {
+			return fmt.Errorf("newOutbox: %w", err)
+		}
+		s.outbox = o
+		go s.outbox.run()
+		go s.outbox.prune()
+	}
+
+	if s.wot != nil {
+		go s.wot.run()
+	}
+
+	go s.snapshotSeenEvents()
+
 	return nil
 }
 
-func (s *storage) BeforeSave(ctx context.Context, event *nostr.Event) {
+func (s *storage) SaveEvent(ctx context.Context, event *nostr.Event) error {
+	if s.accept != nil {
+		if ok, reason := s.accept(ctx, event); !ok {
+			return errors.New(reason)
+		}
+	}
+
+	replaced, err := s.replacedEventIDs(ctx, event)
+	if err != nil {
+		log.Printf("replacedEventIDs: %v\n", err)
+	}
+
+	if err := s.PostgresBackend.SaveEvent(ctx, event); err != nil {
+		return err
+	}
+
+	s.tombstone(ctx, replaced...)
+
+	return nil
 }
 
-func (s *storage) AfterSave(event *nostr.Event) {
-	// Update the Bloom Filter
-	s.seenEvents.Add([]byte(event.ID))
+func (s *storage) QueryEvents(ctx context.Context, filter *nostr.Filter) (chan *nostr.Event, error) {
+	if err := s.allowRead(ctx); err != nil {
+		return nil, err
+	}
 
-	switch event.Kind {
-	case 1808:
-		shareEvent := generateShareEvent(event)
-		if shareEvent != nil && s.blastr != nil {
-			s.blastr.Send(context.Background(), *shareEvent)
+	return s.PostgresBackend.QueryEvents(ctx, filter)
+}
+
+// conditions hides moderated events and, from unauthorized readers,
+// restricted kinds in every query and count.
+func (s *storage) conditions(ctx context.Context) (string, []any) {
+	var (
+		conditions []string
+		params     []any
+	)
+	for _, c := range []func(context.Context) (string, []any){s.moderation.conditions, s.readGate.conditions} {
+		if condition, p := c(ctx); condition != "" {
+			conditions = append(conditions, condition)
+			params = append(params, p...)
 		}
 	}
+
+	return strings.Join(conditions, " AND "), params
 }
 
-func (s *storage) initSeenEvents() error {
-	ids, err := s.getAllEventIDs()
-	if err != nil {
-		return err
+// CountEvents answers NIP-45 COUNTs with the same checks as QueryEvents.
+func (s *storage) CountEvents(ctx context.Context, filter *nostr.Filter) (int64, error) {
+	if err := s.allowRead(ctx); err != nil {
+		return 0, err
 	}
 
-	for _, id := range ids {
-		s.seenEvents.Add([]byte(id))
+	return s.PostgresBackend.CountEvents(ctx, filter)
+}
+
+// allowRead returns the reason a REQ or COUNT is refused, if it is.
+func (s *storage) allowRead(ctx context.Context) error {
+	if s.limits != nil && !s.limits.allowRead(ctx) {
+		return errors.New(reasonReadRateLimited)
+	}
+	if ip, ok := connectionIP(ctx); ok {
+		if allowed, _ := s.access.allowIP(ip); !allowed {
+			return errors.New(reasonIPBlocked)
+		}
 	}
 
-	log.Printf("seenFilter count: %d\n", s.seenEvents.ApproximatedSize())
 	return nil
 }
 
-func (s *storage) getAllEventIDs() ([]string, error) {
-	var ids []string
-	err := s.DB.Select(&ids, "SELECT id FROM event")
-	if err != nil && err != sql.ErrNoRows {
-		return nil, fmt.Errorf("failed to select events: %w", err)
+func (s *storage) BeforeSave(ctx context.Context, event *nostr.Event) {
+}
+
+func (s *storage) AfterSave(event *nostr.Event) {
+	// Update the Bloom Filter
+	s.seenEvents.Add([]byte(event.ID))
+
+	if event.Kind == nostr.KindSetMetadata {
+		s.nip05.refresh(event.PubKey)
 	}
 
-	return ids, nil
-}
+	if event.Kind == nostr.KindContactList && s.wot != nil {
+		s.wot.enqueue(event)
+	}
 
-const (
-	stemstrNpub   = "npub1stemstrls4f5plqeqkeq43gtjhtycuqd9w25v5r5z5ygaq2n2sjsd6mul5"
-	stemstrHexpub = "82f3b82c7f855340fc1905b20ac50b95d64c700d2b9546507415088e81535425"
-)
+	if s.shares == nil || s.blastr == nil {
+		return
+	}
 
-func generateShareEvent(event *nostr.Event) *nostr.Event {
-	npub, err := nip19.EncodePublicKey(event.PubKey)
-	if err != nil {
-		log.Printf("failed to encoded share event npub: %v", err)
-		return nil
+	shareEvent := s.shares.shareEvent(event)
+	if shareEvent == nil {
+		return
 	}
 
-	content := fmt.Sprintf(
-		"🎉 Let's gooo! nostr:%s just shared a track on nostr:%s 🙌.\n\nCheck it out at https://stemstr.app/thread/%s/\n\n#stemstr #music #tunestr",
-		npub, stemstrNpub, event.ID,
-	)
+	if s.outbox != nil {
+		err := s.outbox.enqueue(context.Background(), event.ID, *shareEvent)
+		if err == nil {
+			return
+		}
+		log.Printf("[error] enqueue share event for %s: %v\n", event.ID, err)
+	}
 
-	shareEvent := nostr.Event{
-		Kind: nostr.KindTextNote,
-		Tags: nostr.Tags{
-			{"p", event.PubKey},  // Tag author
-			{"p", stemstrHexpub}, // Tag stemstr
-			{"t", "stemstr"},
-			{"t", "music"},
-			{"t", "tunestr"},
-		},
-		Content: content,
+	// Without an outbox, or if it is unavailable, make a single attempt
+	if err := s.blastr.Send(context.Background(), *shareEvent); err != nil {
+		log.Printf("[error] send share event for %s: %v\n", event.ID, err)
+	}
+}
+
+// firstFromAuthor reports whether evt is its author's first saved event of
+// its kind.
+func (s *storage) firstFromAuthor(evt *nostr.Event) (bool, error) {
+	var exists bool
+	err := s.DB.Get(&exists, "SELECT EXISTS (SELECT 1 FROM event WHERE pubkey = $1 AND kind = $2 AND id <> $3)", evt.PubKey, evt.Kind, evt.ID)
+	if err != nil {
+		return false, fmt.Errorf("select author events: %w", err)
 	}
 
-	return &shareEvent
+	return !exists, nil
 }
@@ -4,7 +4,6 @@ import (
 	"context"
 	"testing"
 
-	"github.com/bits-and-blooms/bloom/v3"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/stretchr/testify/assert"
 )
@@ -50,8 +49,12 @@ func TestAfterSave(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			shares, err := newShareRules(ShareConfig{}, nil)
+			assert.NoError(t, err)
+
 			store := &storage{
-				seenEvents: bloom.New(1000, 5),
+				seenEvents: newSeenFilter(1000, 0.01),
+				shares:     shares,
 				blastr: &mockBlastr{
 					sendAsserter: func(event nostr.Event) {
 						// Make sure the message is properly rendered
@@ -67,6 +70,20 @@ func TestAfterSave(t *testing.T) {
 	}
 }
 
+func TestSaveEventRejected(t *testing.T) {
+	store := &storage{
+		accept: func(ctx context.Context, event *nostr.Event) (bool, string) {
+			return false, reasonSubscriptionRequired
+		},
+	}
+
+	err := store.SaveEvent(context.Background(), &nostr.Event{Kind: 1808})
+	assert.EqualError(t, err, reasonSubscriptionRequired)
+	// The relayer only passes errors through to the client when they carry
+	// a NIP-20 prefix.
+	assert.Regexp(t, `^[\w-]+: `, err.Error())
+}
+
 type mockBlastr struct {
 	sendAsserter func(nostr.Event)
 }
@@ -4,14 +4,24 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 )
 
 var subRequiredKinds = []int{1, 6, 16, 1808}
 
-func kindRequiresSubscription(kind int) bool {
-	for _, k := range subRequiredKinds {
+const (
+	// freeTier is the tier of pubkeys without an active subscription.
+	freeTier = "free"
+	// defaultTier is the tier of subscription rows that don't name one.
+	defaultTier = "paid"
+)
+
+func kindRequiresSubscription(kinds []int, kind int) bool {
+	for _, k := range kinds {
 		if kind == k {
 			return true
 		}
@@ -20,23 +30,187 @@ func kindRequiresSubscription(kind int) bool {
 	return false
 }
 
-func isSubscribed(db *sqlx.DB, pubkey string) (bool, error) {
-	const query = `SELECT id 
+// kindAllowedForTier reports whether tier may publish kind. Without any
+// tiers configured every subscription allows every kind and the free tier
+// allows none.
+func kindAllowedForTier(tiers map[string]TierConfig, tier string, kind int) bool {
+	if len(tiers) == 0 {
+		return tier != freeTier
+	}
+
+	cfg, ok := tiers[tier]
+	if !ok {
+		return false
+	}
+
+	for _, k := range cfg.Kinds {
+		if kind == k {
+			return true
+		}
+	}
+
+	return false
+}
+
+// subscription is the active subscription of a pubkey that lasts longest.
+type subscription struct {
+	Tier      string    `db:"tier"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// lookupSubscription returns the active subscription for pubkey that lasts
+// longest, so a newer but shorter row doesn't shadow it. ok is false if
+// pubkey has no active subscription.
+func lookupSubscription(db *sqlx.DB, pubkey string) (sub subscription, ok bool, err error) {
+	const query = `SELECT COALESCE(tier, '') AS tier, expires_at
 FROM subscription
 WHERE pubkey=$1
 	AND expires_at > NOW()
-ORDER BY created_at DESC
+ORDER BY expires_at DESC, created_at DESC
 LIMIT 1;
 `
 
-	var id string
-	if err := db.Get(&id, query, pubkey); err != nil {
+	if err := db.Get(&sub, query, pubkey); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return false, nil
+			return subscription{}, false, nil
 		}
 
-		return false, fmt.Errorf("db.Get sub: %w", err)
+		return subscription{}, false, fmt.Errorf("db.Get sub: %w", err)
+	}
+
+	if sub.Tier == "" {
+		sub.Tier = defaultTier
+	}
+
+	return sub, true, nil
+}
+
+const defaultSubscriptionNegativeCacheTTL = 10 * time.Second
+
+func newSubscriptionCache(db *sqlx.DB, negativeTTL time.Duration) *subscriptionCache {
+	if negativeTTL <= 0 {
+		negativeTTL = defaultSubscriptionNegativeCacheTTL
 	}
 
-	return true, nil
+	return &subscriptionCache{
+		lookup: func(pubkey string) (subscription, bool, error) {
+			return lookupSubscription(db, pubkey)
+		},
+		negativeTTL: negativeTTL,
+		now:         time.Now,
+		entries:     make(map[string]subscriptionCacheEntry),
+	}
+}
+
+// subscriptionCache caches subscription lookups by pubkey. Subscribed
+// pubkeys are cached until their subscription expires, others for
+// negativeTTL.
+type subscriptionCache struct {
+	lookup      func(pubkey string) (sub subscription, ok bool, err error)
+	negativeTTL time.Duration
+	now         func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]subscriptionCacheEntry
+	nextPrune time.Time
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type subscriptionCacheEntry struct {
+	subscribed bool
+	tier       string
+	validUntil time.Time
+}
+
+type subscriptionCacheStats struct {
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+	Entries int    `json:"entries"`
+}
+
+func (c *subscriptionCache) isSubscribed(pubkey string) (bool, error) {
+	_, subscribed, err := c.tier(pubkey)
+	return subscribed, err
+}
+
+// tier returns the subscription tier of pubkey, or freeTier if it has no
+// active subscription.
+func (c *subscriptionCache) tier(pubkey string) (tier string, subscribed bool, err error) {
+	now := c.now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[pubkey]
+	c.mu.Unlock()
+	if ok && now.Before(entry.validUntil) {
+		c.hits.Add(1)
+		return entry.tier, entry.subscribed, nil
+	}
+	c.misses.Add(1)
+
+	sub, subscribed, err := c.lookup(pubkey)
+	if err != nil {
+		// Don't cache errors, the next event will retry
+		return "", false, err
+	}
+
+	entry = subscriptionCacheEntry{
+		subscribed: subscribed,
+		tier:       sub.Tier,
+		validUntil: sub.ExpiresAt,
+	}
+	if !subscribed {
+		entry.tier = freeTier
+		entry.validUntil = now.Add(c.negativeTTL)
+	}
+
+	c.mu.Lock()
+	c.entries[pubkey] = entry
+	c.prune(now)
+	c.mu.Unlock()
+
+	return entry.tier, subscribed, nil
+}
+
+// prune drops expired entries at most once per negativeTTL so lookups for
+// many one-off pubkeys don't grow the cache forever. c.mu must be held.
+func (c *subscriptionCache) prune(now time.Time) {
+	if now.Before(c.nextPrune) {
+		return
+	}
+	c.nextPrune = now.Add(c.negativeTTL)
+
+	for pubkey, entry := range c.entries {
+		if !now.Before(entry.validUntil) {
+			delete(c.entries, pubkey)
+		}
+	}
+}
+
+// reset drops all cached entries.
+func (c *subscriptionCache) reset() {
+	c.mu.Lock()
+	c.entries = make(map[string]subscriptionCacheEntry)
+	c.mu.Unlock()
+}
+
+// invalidate drops the cached entry for pubkey, e.g. after one of their
+// subscription rows changed, so the next lookup picks their best active
+// subscription.
+func (c *subscriptionCache) invalidate(pubkey string) {
+	c.mu.Lock()
+	delete(c.entries, pubkey)
+	c.mu.Unlock()
+}
+
+func (c *subscriptionCache) stats() subscriptionCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return subscriptionCacheStats{
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+		Entries: len(c.entries),
+	}
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// subscriptionChangedChannel is notified by the trigger in
+// migrations/subscriptions with the operation and the pubkey, tier and expiry
+// of every inserted, updated or deleted subscription row.
+const subscriptionChangedChannel = "subscription_changed"
+
+type subscriptionNotification struct {
+	// Op is INSERT, UPDATE or DELETE. Notifications from before the trigger
+	// sent it have none.
+	Op        string `json:"op"`
+	Pubkey    string `json:"pubkey"`
+	Tier      string `json:"tier"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// listenForSubscriptionChanges keeps subscriptions up to date with
+// subscription rows as they are written.
+func listenForSubscriptionChanges(dbURL string, subscriptions *subscriptionCache) error {
+	listener := pq.NewListener(dbURL, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("subscription listener: %v\n", err)
+		}
+	})
+	if err := listener.Listen(subscriptionChangedChannel); err != nil {
+		listener.Close()
+		return fmt.Errorf("listen %s: %w", subscriptionChangedChannel, err)
+	}
+
+	go func() {
+		for {
+			select {
+			case n := <-listener.Notify:
+				if n == nil {
+					// The connection was re-established and notifications
+					// may have been missed while it was down.
+					log.Printf("subscription listener reconnected, resetting cache\n")
+					subscriptions.reset()
+					continue
+				}
+
+				if err := handleSubscriptionNotification(subscriptions, n.Extra); err != nil {
+					log.Printf("subscription notification: %v\n", err)
+				}
+			case <-time.After(90 * time.Second):
+				go listener.Ping()
+			}
+		}
+	}()
+
+	return nil
+}
+
+func handleSubscriptionNotification(subscriptions *subscriptionCache, payload string) error {
+	var n subscriptionNotification
+	if err := json.Unmarshal([]byte(payload), &n); err != nil {
+		return fmt.Errorf("decode %q: %w", payload, err)
+	}
+	if n.Pubkey == "" {
+		return fmt.Errorf("missing pubkey: %q", payload)
+	}
+
+	// The changed row isn't necessarily the pubkey's best subscription, e.g.
+	// an older one being shortened, so look it up again rather than caching
+	// the row. A deleted row is looked up again the same way, dropping the
+	// entitlement it gave.
+	subscriptions.invalidate(n.Pubkey)
+	log.Printf("subscription changed: %s op: %s tier: %s expires_at: %v\n", n.Pubkey, n.Op, n.Tier, n.ExpiresAt)
+
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscriptionCache(t *testing.T) {
+	now := time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC)
+	expiresAt := now.Add(time.Hour)
+
+	lookups := map[string]int{}
+	c := &subscriptionCache{
+		lookup: func(pubkey string) (subscription, bool, error) {
+			lookups[pubkey]++
+			switch pubkey {
+			case "subscribed":
+				return subscription{Tier: "paid", ExpiresAt: expiresAt}, true, nil
+			case "broken":
+				return subscription{}, false, errors.New("db down")
+			default:
+				return subscription{}, false, nil
+			}
+		},
+		negativeTTL: time.Minute,
+		now:         func() time.Time { return now },
+		entries:     make(map[string]subscriptionCacheEntry),
+	}
+
+	// Subscribed pubkeys are cached until the subscription expires
+	for i := 0; i < 3; i++ {
+		ok, err := c.isSubscribed("subscribed")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+	tier, _, _ := c.tier("subscribed")
+	assert.Equal(t, "paid", tier)
+	assert.Equal(t, 1, lookups["subscribed"])
+
+	now = expiresAt
+	c.isSubscribed("subscribed")
+	assert.Equal(t, 2, lookups["subscribed"])
+
+	// Pubkeys without a subscription are cached for the negative TTL
+	tier, ok, err := c.tier("unsubscribed")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, freeTier, tier)
+	c.isSubscribed("unsubscribed")
+	assert.Equal(t, 1, lookups["unsubscribed"])
+
+	now = now.Add(time.Minute)
+	c.isSubscribed("unsubscribed")
+	assert.Equal(t, 2, lookups["unsubscribed"])
+
+	// Errors are not cached
+	_, err = c.isSubscribed("broken")
+	assert.Error(t, err)
+	c.isSubscribed("broken")
+	assert.Equal(t, 2, lookups["broken"])
+
+	// Invalidate forces a new lookup
+	c.invalidate("unsubscribed")
+	c.isSubscribed("unsubscribed")
+	assert.Equal(t, 3, lookups["unsubscribed"])
+
+	stats := c.stats()
+	assert.Equal(t, uint64(4), stats.Hits)
+	assert.Equal(t, uint64(7), stats.Misses)
+	// The expired subscription was pruned
+	assert.Equal(t, 1, stats.Entries)
+}
+
+func TestHandleSubscriptionNotification(t *testing.T) {
+	now := time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC)
+	var best *subscription
+	c := &subscriptionCache{
+		lookup: func(pubkey string) (subscription, bool, error) {
+			if best == nil {
+				return subscription{}, false, nil
+			}
+			return *best, true, nil
+		},
+		negativeTTL: time.Minute,
+		now:         func() time.Time { return now },
+		entries:     make(map[string]subscriptionCacheEntry),
+	}
+
+	// Cached as not subscribed until a subscription is bought
+	ok, _ := c.isSubscribed("pubkey")
+	assert.False(t, ok)
+
+	best = &subscription{Tier: "pro", ExpiresAt: now.Add(30 * 24 * time.Hour)}
+	err := handleSubscriptionNotification(c, fmt.Sprintf(`{"pubkey":"pubkey","tier":"pro","expires_at":%d}`, best.ExpiresAt.Unix()))
+	assert.NoError(t, err)
+	tier, ok, _ := c.tier("pubkey")
+	assert.True(t, ok)
+	assert.Equal(t, "pro", tier)
+
+	// A change to an older, shorter row doesn't downgrade the pubkey
+	err = handleSubscriptionNotification(c, fmt.Sprintf(`{"pubkey":"pubkey","tier":"basic","expires_at":%d}`, now.Add(time.Hour).Unix()))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, c.stats().Entries)
+	tier, ok, _ = c.tier("pubkey")
+	assert.True(t, ok)
+	assert.Equal(t, "pro", tier)
+	assert.Equal(t, best.ExpiresAt, c.entries["pubkey"].validUntil)
+
+	// Deleting the subscription, e.g. on a refund, drops it right away
+	best = nil
+	err = handleSubscriptionNotification(c, fmt.Sprintf(`{"op":"DELETE","pubkey":"pubkey","tier":"pro","expires_at":%d}`, now.Add(30*24*time.Hour).Unix()))
+	assert.NoError(t, err)
+	ok, _ = c.isSubscribed("pubkey")
+	assert.False(t, ok)
+
+	assert.Error(t, handleSubscriptionNotification(c, `{"expires_at":1}`))
+	assert.Error(t, handleSubscriptionNotification(c, `not json`))
+}
+
+func TestKindAllowedForTier(t *testing.T) {
+	tiers := map[string]TierConfig{
+		freeTier: {Kinds: []int{6, 16}},
+		"paid":   {Kinds: []int{1, 6, 16, 1808}},
+	}
+
+	var tests = []struct {
+		name     string
+		tiers    map[string]TierConfig
+		tier     string
+		kind     int
+		expected bool
+	}{
+		{name: "no tiers, free", tier: freeTier, kind: 6, expected: false},
+		{name: "no tiers, subscribed", tier: defaultTier, kind: 1808, expected: true},
+		{name: "free repost", tiers: tiers, tier: freeTier, kind: 6, expected: true},
+		{name: "free track", tiers: tiers, tier: freeTier, kind: 1808, expected: false},
+		{name: "paid track", tiers: tiers, tier: "paid", kind: 1808, expected: true},
+		{name: "unknown tier", tiers: tiers, tier: "legacy", kind: 6, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, kindAllowedForTier(tt.tiers, tt.tier, tt.kind))
+		})
+	}
+}
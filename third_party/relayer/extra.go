@@ -0,0 +1,23 @@
+package relayer
+
+import "context"
+
+const (
+	AUTH_CONTEXT_KEY = iota
+	IP_CONTEXT_KEY
+)
+
+func GetAuthStatus(ctx context.Context) (pubkey string, ok bool) {
+	authedPubkey := ctx.Value(AUTH_CONTEXT_KEY)
+	if authedPubkey == nil {
+		return "", false
+	}
+	return authedPubkey.(string), true
+}
+
+// GetClientIP returns the IP of the connection a message came from, as
+// found by the WithClientIP option.
+func GetClientIP(ctx context.Context) (ip string, ok bool) {
+	ip, ok = ctx.Value(IP_CONTEXT_KEY).(string)
+	return ip, ok && ip != ""
+}
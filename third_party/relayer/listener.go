@@ -0,0 +1,111 @@
+package relayer
+
+import (
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+type Listener struct {
+	filters nostr.Filters
+}
+
+var (
+	listeners      = make(map[*WebSocket]map[string]*Listener)
+	listenersMutex = sync.Mutex{}
+)
+
+func GetListeningFilters() nostr.Filters {
+	respfilters := make(nostr.Filters, 0, len(listeners)*2)
+
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+
+	// here we go through all the existing listeners
+	for _, connlisteners := range listeners {
+		for _, listener := range connlisteners {
+			for _, listenerfilter := range listener.filters {
+				for _, respfilter := range respfilters {
+					// check if this filter specifically is already added to respfilters
+					if nostr.FilterEqual(listenerfilter, respfilter) {
+						goto nextconn
+					}
+				}
+
+				// field not yet present on respfilters, add it
+				respfilters = append(respfilters, listenerfilter)
+
+				// continue to the next filter
+			nextconn:
+				continue
+			}
+		}
+	}
+
+	// respfilters will be a slice with all the distinct filter we currently have active
+	return respfilters
+}
+
+func setListener(id string, ws *WebSocket, filters nostr.Filters) {
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+
+	subs, ok := listeners[ws]
+	if !ok {
+		subs = make(map[string]*Listener)
+		listeners[ws] = subs
+	}
+
+	subs[id] = &Listener{filters: filters}
+}
+
+// Remove a specific subscription id from listeners for a given ws client
+func removeListenerId(ws *WebSocket, id string) {
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+
+	if subs, ok := listeners[ws]; ok {
+		delete(listeners[ws], id)
+		if len(subs) == 0 {
+			delete(listeners, ws)
+		}
+	}
+}
+
+// Remove WebSocket conn from listeners
+func removeListener(ws *WebSocket) {
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+	delete(listeners, ws)
+}
+
+type listenerMatch struct {
+	ws *WebSocket
+	id string
+}
+
+// notifyListeners sends event to the subscriptions it matches, checking
+// relay's LiveEventFilter, if any, for each.
+func notifyListeners(relay Relay, event *nostr.Event) {
+	var matches []listenerMatch
+
+	listenersMutex.Lock()
+	for ws, subs := range listeners {
+		for id, listener := range subs {
+			if listener.filters.Match(event) {
+				matches = append(matches, listenerMatch{ws: ws, id: id})
+			}
+		}
+	}
+	listenersMutex.Unlock()
+
+	// the filter may be slow, so it's called without holding the lock
+	gate, _ := relay.(LiveEventFilter)
+	for _, m := range matches {
+		if gate != nil && !gate.AllowLiveEvent(m.ws.context(), event) {
+			continue
+		}
+		id := m.id
+		m.ws.WriteJSON(nostr.EventEnvelope{SubscriptionID: &id, Event: *event})
+	}
+}
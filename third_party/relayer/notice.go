@@ -0,0 +1,6 @@
+package relayer
+
+type Notice struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
@@ -0,0 +1,5 @@
+package storage
+
+import "errors"
+
+var ErrDupEvent = errors.New("duplicate: event already exists")
@@ -0,0 +1,22 @@
+package postgresql
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type PostgresBackend struct {
+	*sqlx.DB
+	DatabaseURL       string
+	QueryLimit        int
+	QueryIDsLimit     int
+	QueryAuthorsLimit int
+	QueryKindsLimit   int
+	QueryTagsLimit    int
+
+	// Conditions, if set, returns an SQL condition, with ? placeholders,
+	// that every event queried or counted with ctx must also match, e.g.
+	// to hide moderated events.
+	Conditions func(ctx context.Context) (condition string, params []any)
+}
@@ -0,0 +1,10 @@
+package sqlite3
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+type SQLite3Backend struct {
+	*sqlx.DB
+	DatabaseURL string
+}
@@ -0,0 +1,64 @@
+package relayer
+
+import (
+	"context"
+	"sync"
+
+	"github.com/fasthttp/websocket"
+	"golang.org/x/time/rate"
+)
+
+type WebSocket struct {
+	conn  *websocket.Conn
+	mutex sync.Mutex
+
+	// ip is the client's IP, see WithClientIP
+	ip string
+
+	// nip42
+	challenge string
+	authedMu  sync.RWMutex
+	authed    string
+	limiter   *rate.Limiter
+}
+
+// IP returns the client's IP, see WithClientIP.
+func (ws *WebSocket) IP() string {
+	return ws.ip
+}
+
+// Authed returns the pubkey the connection authenticated as over NIP-42, or
+// an empty string.
+func (ws *WebSocket) Authed() string {
+	ws.authedMu.RLock()
+	defer ws.authedMu.RUnlock()
+	return ws.authed
+}
+
+// context returns a context carrying the connection's IP and NIP-42
+// status, as passed to storage for each message and to LiveEventFilter.
+func (ws *WebSocket) context() context.Context {
+	ctx := context.WithValue(context.Background(), IP_CONTEXT_KEY, ws.ip)
+	if authed := ws.Authed(); authed != "" {
+		ctx = context.WithValue(ctx, AUTH_CONTEXT_KEY, authed)
+	}
+	return ctx
+}
+
+func (ws *WebSocket) setAuthed(pubkey string) {
+	ws.authedMu.Lock()
+	defer ws.authedMu.Unlock()
+	ws.authed = pubkey
+}
+
+func (ws *WebSocket) WriteJSON(any interface{}) error {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	return ws.conn.WriteJSON(any)
+}
+
+func (ws *WebSocket) WriteMessage(t int, b []byte) error {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	return ws.conn.WriteMessage(t, b)
+}
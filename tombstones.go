@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	// tombstonesRefreshInterval is how often tombstones are reloaded,
+	// picking up deletions made through other relay instances.
+	tombstonesRefreshInterval = time.Minute
+
+	defaultTombstoneRetention = 90 * 24 * time.Hour
+)
+
+// tombstones are ids of deleted events. Bloom filters can't forget ids, so
+// references to them are checked here after a seen events filter hit.
+type tombstones struct {
+	now func() time.Time
+
+	mu sync.RWMutex
+	// ids are the tombstoned ids, with when they were added in memory or
+	// the zero time if they were loaded.
+	ids map[string]time.Time
+}
+
+func newTombstones() *tombstones {
+	return &tombstones{now: time.Now, ids: make(map[string]time.Time)}
+}
+
+// set replaces the tombstoned ids with ids, loaded from the database at
+// since. Ids added after since are kept, as the load may have missed them.
+func (t *tombstones) set(ids []string, since time.Time) {
+	m := make(map[string]time.Time, len(ids))
+	for _, id := range ids {
+		m[id] = time.Time{}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for id, added := range t.ids {
+		if !added.Before(since) {
+			m[id] = added
+		}
+	}
+	t.ids = m
+}
+
+func (t *tombstones) add(id string) {
+	t.mu.Lock()
+	t.ids[id] = t.now()
+	t.mu.Unlock()
+}
+
+// contains is safe to call on a nil *tombstones.
+func (t *tombstones) contains(id string) bool {
+	if t == nil {
+		return false
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	_, ok := t.ids[id]
+	return ok
+}
+
+func (t *tombstones) len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return len(t.ids)
+}
+
+func (s *storage) initTombstones() error {
+	if _, err := s.DB.Exec(`
+CREATE TABLE IF NOT EXISTS event_tombstone (
+  id text PRIMARY KEY,
+  deleted_at timestamptz NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS event_tombstone_deleted_at ON event_tombstone (deleted_at);
+`); err != nil {
+		return fmt.Errorf("create table: %w", err)
+	}
+
+	s.tombstones = newTombstones()
+	if err := s.loadTombstones(); err != nil {
+		return err
+	}
+
+	log.Printf("tombstones count: %d\n", s.tombstones.len())
+	return nil
+}
+
+func (s *storage) tombstoneRetention() time.Duration {
+	if s.cfg.TombstoneRetention > 0 {
+		return s.cfg.TombstoneRetention
+	}
+
+	return defaultTombstoneRetention
+}
+
+// loadTombstones replaces the in-memory tombstones with those in the
+// database that are within the retention.
+func (s *storage) loadTombstones() error {
+	since := s.tombstones.now()
+
+	var ids []string
+	err := s.DB.Select(&ids, "SELECT id FROM event_tombstone WHERE deleted_at >= $1", since.Add(-s.tombstoneRetention()))
+	if err != nil {
+		return fmt.Errorf("select tombstones: %w", err)
+	}
+
+	s.tombstones.set(ids, since)
+	return nil
+}
+
+// refreshTombstones deletes tombstones older than the retention and reloads
+// the rest every tombstonesRefreshInterval. It never returns.
+func (s *storage) refreshTombstones() {
+	for range time.Tick(tombstonesRefreshInterval) {
+		if _, err := s.DB.Exec("DELETE FROM event_tombstone WHERE deleted_at < $1", time.Now().Add(-s.tombstoneRetention())); err != nil {
+			log.Printf("[error] prune tombstones: %v\n", err)
+		}
+		if err := s.loadTombstones(); err != nil {
+			log.Printf("[error] refresh tombstones: %v\n", err)
+		}
+	}
+}
+
+// tombstone removes ids from the reference index.
+func (s *storage) tombstone(ctx context.Context, ids ...string) {
+	for _, id := range ids {
+		s.tombstones.add(id)
+		if s.references != nil {
+			s.references.confirmed.remove(id)
+		}
+
+		if _, err := s.DB.ExecContext(ctx, "INSERT INTO event_tombstone (id) VALUES ($1) ON CONFLICT (id) DO NOTHING", id); err != nil {
+			log.Printf("[error] tombstone %s: %v\n", id, err)
+		}
+	}
+}
+
+// DeleteEvent deletes the event and, if it existed, removes it from the
+// reference index. It is used by NIP-09 deletions and the admin UI.
+func (s *storage) DeleteEvent(ctx context.Context, id string, pubkey string) error {
+	if ok, reason := s.access.checkDeletion(ctx, pubkey); !ok {
+		return errors.New(reason)
+	}
+
+	res, err := s.DB.ExecContext(ctx, "DELETE FROM event WHERE id = $1 AND pubkey = $2", id, pubkey)
+	if err != nil {
+		return err
+	}
+
+	// Deletions by anyone but the author don't match any rows and must not
+	// tombstone the event.
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		s.tombstone(ctx, id)
+	}
+
+	return nil
+}
+
+// replacedEventIDs returns the ids of events that saving evt will delete,
+// mirroring the relayer's handling of replaceable events.
+func (s *storage) replacedEventIDs(ctx context.Context, evt *nostr.Event) ([]string, error) {
+	var (
+		query  string
+		params []any
+	)
+	switch {
+	case evt.Kind == nostr.KindSetMetadata || evt.Kind == nostr.KindContactList || (10000 <= evt.Kind && evt.Kind < 20000):
+		query = "SELECT id FROM event WHERE pubkey = $1 AND kind = $2 AND id <> $3"
+		params = []any{evt.PubKey, evt.Kind, evt.ID}
+	case evt.Kind == nostr.KindRecommendServer:
+		query = "SELECT id FROM event WHERE pubkey = $1 AND kind = $2 AND content = $3 AND id <> $4"
+		params = []any{evt.PubKey, evt.Kind, evt.Content, evt.ID}
+	case 30000 <= evt.Kind && evt.Kind < 40000:
+		d := evt.Tags.GetFirst([]string{"d"})
+		if d == nil {
+			return nil, nil
+		}
+		query = "SELECT id FROM event WHERE pubkey = $1 AND kind = $2 AND tagvalues && ARRAY[$3] AND id <> $4"
+		params = []any{evt.PubKey, evt.Kind, d.Value(), evt.ID}
+	default:
+		return nil, nil
+	}
+
+	var ids []string
+	if err := s.DB.SelectContext(ctx, &ids, query, params...); err != nil {
+		return nil, fmt.Errorf("select replaced events: %w", err)
+	}
+
+	return ids, nil
+}
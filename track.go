@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// maxTrackTitleLength is the longest title tag a track may have.
+const maxTrackTitleLength = 200
+
+// trackValidator checks that kind 1808 tracks follow the Stemstr schema:
+//
+//	["stream_url", "<https url>", "<mime type>"]
+//	["download_url", "<https url>", "<mime type>"]
+//	["waveform", "<json array of numbers>"]
+//	["m", "<audio mime type>"]
+//	["x", "<sha256 hex of the download>"]
+//	["title", "<title>"] (optional)
+type trackValidator struct {
+	// mediaHosts, if set, are the only hosts track URLs may point to.
+	// Subdomains of a host are allowed too.
+	mediaHosts []string
+}
+
+// validate returns why evt isn't a valid track, or an empty string.
+func (v trackValidator) validate(evt *nostr.Event) string {
+	for _, name := range []string{"stream_url", "download_url"} {
+		tag := evt.Tags.GetFirst([]string{name})
+		if tag == nil || tag.Value() == "" {
+			return fmt.Sprintf("invalid: track requires a %s tag", name)
+		}
+		if reason := v.validateURL(name, tag.Value()); reason != "" {
+			return reason
+		}
+	}
+
+	waveform := evt.Tags.GetFirst([]string{"waveform"})
+	if waveform == nil || waveform.Value() == "" {
+		return "invalid: track requires a waveform tag"
+	}
+	var samples []float64
+	if err := json.Unmarshal([]byte(waveform.Value()), &samples); err != nil || len(samples) == 0 {
+		return "invalid: track waveform must be a JSON array of numbers"
+	}
+
+	mime := evt.Tags.GetFirst([]string{"m"})
+	if mime == nil || mime.Value() == "" {
+		return "invalid: track requires an m tag"
+	}
+	if !strings.HasPrefix(mime.Value(), "audio/") {
+		return "invalid: track m tag must be an audio mime type"
+	}
+
+	hash := evt.Tags.GetFirst([]string{"x"})
+	if hash == nil || hash.Value() == "" {
+		return "invalid: track requires an x tag"
+	}
+	if !isSHA256Hex(hash.Value()) {
+		return "invalid: track x tag must be a lowercase hex sha256 hash"
+	}
+
+	if title := evt.Tags.GetFirst([]string{"title"}); title != nil {
+		if title.Value() == "" || len(title.Value()) > maxTrackTitleLength {
+			return fmt.Sprintf("invalid: track title must be 1 to %d bytes", maxTrackTitleLength)
+		}
+	}
+
+	return ""
+}
+
+func (v trackValidator) validateURL(name, rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return fmt.Sprintf("invalid: track %s is not a URL", name)
+	}
+	if u.Scheme != "https" {
+		return fmt.Sprintf("invalid: track %s must be https", name)
+	}
+	if !v.allowedHost(u.Hostname()) {
+		return fmt.Sprintf("invalid: track %s host %s is not allowed", name, u.Hostname())
+	}
+
+	return ""
+}
+
+func (v trackValidator) allowedHost(host string) bool {
+	if len(v.mediaHosts) == 0 {
+		return true
+	}
+
+	host = strings.ToLower(host)
+	for _, allowed := range v.mediaHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isSHA256Hex(s string) bool {
+	if len(s) != 64 || strings.ToLower(s) != s {
+		return false
+	}
+
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// trackSchemaPolicy rejects 1808s that don't follow the track schema.
+type trackSchemaPolicy struct {
+	validator trackValidator
+}
+
+func (p trackSchemaPolicy) Name() string { return "track_schema" }
+
+func (p trackSchemaPolicy) Evaluate(ctx context.Context, evt *nostr.Event) (bool, string) {
+	if evt.Kind != 1808 {
+		return true, ""
+	}
+
+	if reason := p.validator.validate(evt); reason != "" {
+		return false, reason
+	}
+
+	return true, ""
+}
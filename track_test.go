@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+const testTrackHash = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+// trackTags returns the tags of a valid track, replacing or adding the
+// given tags and dropping those named in drop.
+func trackTags(replace nostr.Tags, drop ...string) nostr.Tags {
+	tags := nostr.Tags{
+		{"stream_url", "https://media.stemstr.app/stream/abc.m3u8", "application/vnd.apple.mpegurl"},
+		{"download_url", "https://media.stemstr.app/download/abc.wav", "audio/wav"},
+		{"waveform", "[0, 0.5, 1, 0.25]"},
+		{"m", "audio/wav"},
+		{"x", testTrackHash},
+		{"client", "stemstr.app"},
+	}
+
+	var out nostr.Tags
+	for _, tag := range tags {
+		dropped := false
+		for _, name := range drop {
+			dropped = dropped || tag.Key() == name
+		}
+		for _, r := range replace {
+			dropped = dropped || tag.Key() == r.Key()
+		}
+		if !dropped {
+			out = append(out, tag)
+		}
+	}
+
+	return append(out, replace...)
+}
+
+func TestTrackValidator(t *testing.T) {
+	var tests = []struct {
+		name       string
+		mediaHosts []string
+		tags       nostr.Tags
+		expected   string
+	}{
+		{
+			name:     "valid track",
+			tags:     trackTags(nil),
+			expected: "",
+		},
+		{
+			name:     "valid track with title",
+			tags:     trackTags(nostr.Tags{{"title", "sunrise"}}),
+			expected: "",
+		},
+		{
+			name:     "missing stream url",
+			tags:     trackTags(nil, "stream_url"),
+			expected: "invalid: track requires a stream_url tag",
+		},
+		{
+			name:     "missing download url",
+			tags:     trackTags(nil, "download_url"),
+			expected: "invalid: track requires a download_url tag",
+		},
+		{
+			name:     "http url",
+			tags:     trackTags(nostr.Tags{{"download_url", "http://media.stemstr.app/download/abc.wav"}}),
+			expected: "invalid: track download_url must be https",
+		},
+		{
+			name:     "not a url",
+			tags:     trackTags(nostr.Tags{{"stream_url", "abc.m3u8"}}),
+			expected: "invalid: track stream_url is not a URL",
+		},
+		{
+			name:       "allowed media host",
+			mediaHosts: []string{"stemstr.app"},
+			tags:       trackTags(nil),
+			expected:   "",
+		},
+		{
+			name:       "disallowed media host",
+			mediaHosts: []string{"stemstr.app"},
+			tags:       trackTags(nostr.Tags{{"download_url", "https://evilstemstr.app/abc.wav"}}),
+			expected:   "invalid: track download_url host evilstemstr.app is not allowed",
+		},
+		{
+			name:     "missing waveform",
+			tags:     trackTags(nil, "waveform"),
+			expected: "invalid: track requires a waveform tag",
+		},
+		{
+			name:     "malformed waveform",
+			tags:     trackTags(nostr.Tags{{"waveform", "loud"}}),
+			expected: "invalid: track waveform must be a JSON array of numbers",
+		},
+		{
+			name:     "empty waveform",
+			tags:     trackTags(nostr.Tags{{"waveform", "[]"}}),
+			expected: "invalid: track waveform must be a JSON array of numbers",
+		},
+		{
+			name:     "missing mime type",
+			tags:     trackTags(nil, "m"),
+			expected: "invalid: track requires an m tag",
+		},
+		{
+			name:     "non audio mime type",
+			tags:     trackTags(nostr.Tags{{"m", "video/mp4"}}),
+			expected: "invalid: track m tag must be an audio mime type",
+		},
+		{
+			name:     "missing hash",
+			tags:     trackTags(nil, "x"),
+			expected: "invalid: track requires an x tag",
+		},
+		{
+			name:     "short hash",
+			tags:     trackTags(nostr.Tags{{"x", "9f86d081"}}),
+			expected: "invalid: track x tag must be a lowercase hex sha256 hash",
+		},
+		{
+			name:     "uppercase hash",
+			tags:     trackTags(nostr.Tags{{"x", strings.ToUpper(testTrackHash)}}),
+			expected: "invalid: track x tag must be a lowercase hex sha256 hash",
+		},
+		{
+			name:     "non hex hash",
+			tags:     trackTags(nostr.Tags{{"x", strings.Repeat("z", 64)}}),
+			expected: "invalid: track x tag must be a lowercase hex sha256 hash",
+		},
+		{
+			name:     "empty title",
+			tags:     trackTags(nostr.Tags{{"title", ""}}),
+			expected: "invalid: track title must be 1 to 200 bytes",
+		},
+		{
+			name:     "long title",
+			tags:     trackTags(nostr.Tags{{"title", strings.Repeat("a", maxTrackTitleLength+1)}}),
+			expected: "invalid: track title must be 1 to 200 bytes",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := trackValidator{mediaHosts: tt.mediaHosts}
+			assert.Equal(t, tt.expected, v.validate(&nostr.Event{Kind: 1808, Tags: tt.tags}))
+		})
+	}
+}
+
+func TestTrackSchemaPolicy(t *testing.T) {
+	p := trackSchemaPolicy{}
+
+	ok, _ := p.Evaluate(context.Background(), &nostr.Event{Kind: 1})
+	assert.True(t, ok)
+
+	ok, reason := p.Evaluate(context.Background(), &nostr.Event{Kind: 1808})
+	assert.False(t, ok)
+	assert.Equal(t, "invalid: track requires a stream_url tag", reason)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// defaultRequiredTags are the tags each kind must carry when
+// limits.required_tags isn't configured. Tracks are checked in full by the
+// track_schema policy.
+var defaultRequiredTags = map[int][]string{
+	// NIP-94: File Metadata
+	1063: {"url", "m", "x"},
+}
+
+// eventLimitsPolicy bounds the number of tags, the length of tag values and
+// the length of the content. Zero limits are not enforced.
+type eventLimitsPolicy struct {
+	maxTags           int
+	maxTagValueLength int
+	maxContentLength  int
+}
+
+func (p eventLimitsPolicy) Name() string { return "event_limits" }
+
+func (p eventLimitsPolicy) Evaluate(ctx context.Context, evt *nostr.Event) (bool, string) {
+	if p.maxTags > 0 && len(evt.Tags) > p.maxTags {
+		return false, fmt.Sprintf("invalid: too many tags, max is %d", p.maxTags)
+	}
+
+	if p.maxTagValueLength > 0 {
+		for _, tag := range evt.Tags {
+			for _, value := range tag {
+				if len(value) > p.maxTagValueLength {
+					return false, fmt.Sprintf("invalid: %s tag value too long, max is %d", tag.Key(), p.maxTagValueLength)
+				}
+			}
+		}
+	}
+
+	if p.maxContentLength > 0 && len(evt.Content) > p.maxContentLength {
+		return false, fmt.Sprintf("invalid: content too long, max is %d", p.maxContentLength)
+	}
+
+	return true, ""
+}
+
+// requiredTagsPolicy rejects events missing a tag their kind requires, or
+// whose required tag has no value.
+type requiredTagsPolicy struct {
+	tags map[int][]string
+}
+
+func (p requiredTagsPolicy) Name() string { return "required_tags" }
+
+func (p requiredTagsPolicy) Evaluate(ctx context.Context, evt *nostr.Event) (bool, string) {
+	for _, name := range p.tags[evt.Kind] {
+		tag := evt.Tags.GetFirst([]string{name})
+		if tag == nil {
+			return false, fmt.Sprintf("invalid: kind %d requires a %s tag", evt.Kind, name)
+		}
+		if tag.Value() == "" {
+			return false, fmt.Sprintf("invalid: %s tag has no value", name)
+		}
+	}
+
+	return true, ""
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventLimitsPolicy(t *testing.T) {
+	limits := eventLimitsPolicy{
+		maxTags:           3,
+		maxTagValueLength: 10,
+		maxContentLength:  20,
+	}
+
+	var tests = []struct {
+		name     string
+		policy   eventLimitsPolicy
+		event    *nostr.Event
+		expected string
+	}{
+		{
+			name:     "within limits",
+			policy:   limits,
+			event:    &nostr.Event{Kind: 1, Content: "hello", Tags: nostr.Tags{{"t", "music"}}},
+			expected: "",
+		},
+		{
+			name:     "too many tags",
+			policy:   limits,
+			event:    &nostr.Event{Kind: 1, Tags: nostr.Tags{{"t", "a"}, {"t", "b"}, {"t", "c"}, {"t", "d"}}},
+			expected: "invalid: too many tags, max is 3",
+		},
+		{
+			name:     "tag value too long",
+			policy:   limits,
+			event:    &nostr.Event{Kind: 1, Tags: nostr.Tags{{"t", "a"}, {"r", "https://example.com"}}},
+			expected: "invalid: r tag value too long, max is 10",
+		},
+		{
+			name:     "content too long",
+			policy:   limits,
+			event:    &nostr.Event{Kind: 1, Content: strings.Repeat("x", 21)},
+			expected: "invalid: content too long, max is 20",
+		},
+		{
+			name:     "no limits",
+			event:    &nostr.Event{Kind: 1, Content: strings.Repeat("x", 21)},
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, reason := tt.policy.Evaluate(context.Background(), tt.event)
+			assert.Equal(t, tt.expected == "", ok)
+			assert.Equal(t, tt.expected, reason)
+		})
+	}
+}
+
+func TestRequiredTagsPolicy(t *testing.T) {
+	p := requiredTagsPolicy{tags: defaultRequiredTags}
+
+	var tests = []struct {
+		name     string
+		event    *nostr.Event
+		expected string
+	}{
+		{
+			name: "file metadata",
+			event: &nostr.Event{Kind: 1063, Tags: nostr.Tags{
+				{"url", "https://example.com/a.wav"},
+				{"m", "audio/wav"},
+				{"x", "abc"},
+			}},
+			expected: "",
+		},
+		{
+			name: "file metadata without hash",
+			event: &nostr.Event{Kind: 1063, Tags: nostr.Tags{
+				{"url", "https://example.com/a.wav"},
+				{"m", "audio/wav"},
+			}},
+			expected: "invalid: kind 1063 requires a x tag",
+		},
+		{
+			name: "file metadata with empty url",
+			event: &nostr.Event{Kind: 1063, Tags: nostr.Tags{
+				{"url", ""},
+				{"m", "audio/wav"},
+				{"x", "abc"},
+			}},
+			expected: "invalid: url tag has no value",
+		},
+		{
+			name:     "kind without required tags",
+			event:    &nostr.Event{Kind: 1},
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, reason := p.Evaluate(context.Background(), tt.event)
+			assert.Equal(t, tt.expected == "", ok)
+			assert.Equal(t, tt.expected, reason)
+		})
+	}
+}
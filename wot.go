@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	defaultWebOfTrustMaxHops = 2
+	// contactListsBatchSize is how many pubkeys' contact lists are fetched
+	// at a time.
+	contactListsBatchSize = 1000
+	// defaultWebOfTrustRebuildInterval is how often the trusted pubkeys are
+	// rebuilt from freshly fetched contact lists.
+	defaultWebOfTrustRebuildInterval = time.Hour
+	// webOfTrustRetryInterval is how soon a failed rebuild is retried.
+	webOfTrustRetryInterval = time.Minute
+	// webOfTrustQueueSize is how many saved contact lists may wait to be
+	// applied.
+	webOfTrustQueueSize = 1000
+)
+
+// webOfTrust tracks the pubkeys within maxHops follows of the seed pubkeys,
+// following the kind 3 contact lists saved in the relay.
+type webOfTrust struct {
+	seeds           []string
+	maxHops         int
+	rebuildInterval time.Duration
+	// contactLists returns the latest contact list of each pubkey with one.
+	contactLists func(pubkeys []string) (map[string]contactList, error)
+
+	// updates are saved contact lists waiting for run to apply them in
+	// order.
+	updates chan contactListUpdate
+
+	// updateMu serializes rebuilds and updates.
+	updateMu sync.Mutex
+
+	mu sync.RWMutex
+	// distance is how many hops each trusted pubkey is from the seeds.
+	distance map[string]int
+	// follows caches the contact lists of pubkeys closer than maxHops,
+	// the only ones that can add trusted pubkeys.
+	follows map[string]contactList
+}
+
+// contactList is the followed pubkeys of a kind 3 event. It is empty for
+// pubkeys without one.
+type contactList struct {
+	follows   []string
+	createdAt nostr.Timestamp
+}
+
+type contactListUpdate struct {
+	pubkey string
+	list   contactList
+}
+
+type webOfTrustStats struct {
+	Seeds   int `json:"seeds"`
+	MaxHops int `json:"max_hops"`
+	Trusted int `json:"trusted"`
+}
+
+func newWebOfTrust(cfg WebOfTrustConfig, contactLists func([]string) (map[string]contactList, error)) *webOfTrust {
+	maxHops := cfg.MaxHops
+	if maxHops <= 0 {
+		maxHops = defaultWebOfTrustMaxHops
+	}
+	rebuildInterval := cfg.RebuildInterval
+	if rebuildInterval <= 0 {
+		rebuildInterval = defaultWebOfTrustRebuildInterval
+	}
+
+	return &webOfTrust{
+		seeds:           cfg.Seeds,
+		maxHops:         maxHops,
+		rebuildInterval: rebuildInterval,
+		contactLists:    contactLists,
+		updates:         make(chan contactListUpdate, webOfTrustQueueSize),
+		distance:        make(map[string]int),
+		follows:         make(map[string]contactList),
+	}
+}
+
+// run refreshes the trusted pubkeys every rebuildInterval, retrying sooner
+// when that fails, and applies saved contact lists in the order they were
+// saved. Until the first refresh succeeds nobody is trusted, which only
+// means falling back to the other checks.
+func (w *webOfTrust) run() {
+	timer := time.NewTimer(0)
+	for {
+		select {
+		case u := <-w.updates:
+			w.update(u.pubkey, u.list)
+		case <-timer.C:
+			if err := w.refresh(); err != nil {
+				log.Printf("[error] web of trust: %v\n", err)
+				timer.Reset(webOfTrustRetryInterval)
+				continue
+			}
+			log.Printf("web of trust: %+v\n", w.stats())
+			timer.Reset(w.rebuildInterval)
+		}
+	}
+}
+
+// enqueue queues a saved contact list for run to apply. If the queue is
+// full the list is dropped and picked up by the next refresh.
+func (w *webOfTrust) enqueue(evt *nostr.Event) {
+	u := contactListUpdate{
+		pubkey: evt.PubKey,
+		list:   contactList{follows: followedPubkeys(evt.Tags), createdAt: evt.CreatedAt},
+	}
+
+	select {
+	case w.updates <- u:
+	default:
+		log.Printf("[error] web of trust queue full, dropped contact list %s\n", evt.ID)
+	}
+}
+
+// trusted reports whether pubkey is within maxHops of the seeds. It is safe
+// to call on a nil *webOfTrust.
+func (w *webOfTrust) trusted(pubkey string) bool {
+	if w == nil {
+		return false
+	}
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	_, ok := w.distance[pubkey]
+	return ok
+}
+
+// refresh forgets the cached contact lists and rebuilds, so lists that were
+// missed, e.g. dropped from a full queue, are fetched again.
+func (w *webOfTrust) refresh() error {
+	w.updateMu.Lock()
+	defer w.updateMu.Unlock()
+
+	w.mu.Lock()
+	cached := w.follows
+	w.follows = make(map[string]contactList)
+	w.mu.Unlock()
+
+	if err := w.rebuildLocked(); err != nil {
+		// Keep the old lists rather than fetching them all again next time
+		w.mu.Lock()
+		for pubkey, list := range cached {
+			if _, ok := w.follows[pubkey]; !ok {
+				w.follows[pubkey] = list
+			}
+		}
+		w.mu.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+// rebuild computes the trusted pubkeys from scratch, reusing cached
+// contact lists.
+func (w *webOfTrust) rebuild() error {
+	w.updateMu.Lock()
+	defer w.updateMu.Unlock()
+
+	return w.rebuildLocked()
+}
+
+// rebuildLocked is rebuild with w.updateMu held.
+func (w *webOfTrust) rebuildLocked() error {
+	distance := make(map[string]int)
+	for _, seed := range w.seeds {
+		distance[seed] = 0
+	}
+
+	if err := w.propagate(distance, w.seeds); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.distance = distance
+	// Forget contact lists of pubkeys no longer close enough to matter
+	for pubkey := range w.follows {
+		if d, ok := distance[pubkey]; !ok || d >= w.maxHops {
+			delete(w.follows, pubkey)
+		}
+	}
+	w.mu.Unlock()
+
+	return nil
+}
+
+// update applies a newly saved contact list, unless the cached one is
+// newer. Added follows are propagated from the author; removed ones need a
+// rebuild, as trusted pubkeys may now be further away or out of reach.
+func (w *webOfTrust) update(pubkey string, list contactList) {
+	w.updateMu.Lock()
+	defer w.updateMu.Unlock()
+
+	w.mu.Lock()
+	old, cached := w.follows[pubkey]
+	if !cached || list.createdAt < old.createdAt {
+		// Only cached contact lists can affect trust. If the author comes
+		// within range later their latest list is fetched then.
+		w.mu.Unlock()
+		return
+	}
+	w.follows[pubkey] = list
+	w.mu.Unlock()
+
+	current := make(map[string]bool, len(list.follows))
+	for _, f := range list.follows {
+		current[f] = true
+	}
+	for _, f := range old.follows {
+		if !current[f] {
+			if err := w.rebuildLocked(); err != nil {
+				log.Printf("[error] web of trust rebuild: %v\n", err)
+			}
+			return
+		}
+	}
+
+	w.mu.Lock()
+	err := w.propagateLocked(w.distance, []string{pubkey})
+	w.mu.Unlock()
+	if err != nil {
+		log.Printf("[error] web of trust update %s: %v\n", pubkey, err)
+	}
+}
+
+// propagate relaxes the distance of everyone followed from frontier,
+// layer by layer, fetching contact lists that aren't cached yet.
+func (w *webOfTrust) propagate(distance map[string]int, frontier []string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.propagateLocked(distance, frontier)
+}
+
+// propagateLocked is propagate with w.mu held. It is released while
+// contact lists are fetched.
+func (w *webOfTrust) propagateLocked(distance map[string]int, frontier []string) error {
+	for len(frontier) > 0 {
+		var missing []string
+		for _, pubkey := range frontier {
+			if _, ok := w.follows[pubkey]; !ok && distance[pubkey] < w.maxHops {
+				missing = append(missing, pubkey)
+			}
+		}
+
+		if len(missing) > 0 {
+			w.mu.Unlock()
+			lists, err := w.fetchContactLists(missing)
+			w.mu.Lock()
+			if err != nil {
+				return err
+			}
+
+			for _, pubkey := range missing {
+				// Cache pubkeys without a contact list too, so they
+				// aren't fetched again.
+				w.follows[pubkey] = lists[pubkey]
+			}
+		}
+
+		var next []string
+		for _, pubkey := range frontier {
+			d := distance[pubkey]
+			if d >= w.maxHops {
+				continue
+			}
+
+			for _, f := range w.follows[pubkey].follows {
+				if current, ok := distance[f]; !ok || current > d+1 {
+					distance[f] = d + 1
+					next = append(next, f)
+				}
+			}
+		}
+		frontier = next
+	}
+
+	return nil
+}
+
+func (w *webOfTrust) fetchContactLists(pubkeys []string) (map[string]contactList, error) {
+	lists := make(map[string]contactList)
+	for start := 0; start < len(pubkeys); start += contactListsBatchSize {
+		end := start + contactListsBatchSize
+		if end > len(pubkeys) {
+			end = len(pubkeys)
+		}
+
+		batch, err := w.contactLists(pubkeys[start:end])
+		if err != nil {
+			return nil, err
+		}
+		for pubkey, list := range batch {
+			lists[pubkey] = list
+		}
+	}
+
+	return lists, nil
+}
+
+func (w *webOfTrust) stats() webOfTrustStats {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return webOfTrustStats{
+		Seeds:   len(w.seeds),
+		MaxHops: w.maxHops,
+		Trusted: len(w.distance),
+	}
+}
+
+// followedPubkeys returns the pubkeys in a contact list's p tags.
+func followedPubkeys(tags nostr.Tags) []string {
+	var pubkeys []string
+	for _, tag := range tags.GetAll([]string{"p"}) {
+		if pubkey := tag.Value(); pubkey != "" {
+			pubkeys = append(pubkeys, pubkey)
+		}
+	}
+
+	return pubkeys
+}
+
+// contactLists returns the latest contact list of each of pubkeys that has
+// one.
+func (s *storage) contactLists(pubkeys []string) (map[string]contactList, error) {
+	rows, err := s.DB.QueryxContext(context.Background(), `SELECT DISTINCT ON (pubkey) pubkey, created_at, tags
+FROM event
+WHERE kind = 3 AND pubkey = ANY($1)
+ORDER BY pubkey, created_at DESC`, pq.Array(pubkeys))
+	if err != nil {
+		return nil, fmt.Errorf("select contact lists: %w", err)
+	}
+	defer rows.Close()
+
+	lists := make(map[string]contactList)
+	for rows.Next() {
+		var (
+			pubkey    string
+			createdAt nostr.Timestamp
+			tagsb     []byte
+			tags      nostr.Tags
+		)
+		if err := rows.Scan(&pubkey, &createdAt, &tagsb); err != nil {
+			return nil, fmt.Errorf("scan contact list: %w", err)
+		}
+		if err := json.Unmarshal(tagsb, &tags); err != nil {
+			log.Printf("contact list of %s: %v\n", pubkey, err)
+			continue
+		}
+		lists[pubkey] = contactList{follows: followedPubkeys(tags), createdAt: createdAt}
+	}
+
+	return lists, rows.Err()
+}
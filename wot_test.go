@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeContactLists serves contact lists from a map, recording the pubkeys
+// fetched. They are all created at 1.
+type fakeContactLists struct {
+	lists   map[string][]string
+	fetched []string
+	err     error
+}
+
+func (f *fakeContactLists) get(pubkeys []string) (map[string]contactList, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	f.fetched = append(f.fetched, pubkeys...)
+	lists := make(map[string]contactList)
+	for _, pubkey := range pubkeys {
+		if follows, ok := f.lists[pubkey]; ok {
+			lists[pubkey] = contactList{follows: follows, createdAt: 1}
+		}
+	}
+
+	return lists, nil
+}
+
+func TestWebOfTrustRebuild(t *testing.T) {
+	var tests = []struct {
+		name     string
+		maxHops  int
+		trusted  []string
+		excluded []string
+	}{
+		{
+			name:     "one hop",
+			maxHops:  1,
+			trusted:  []string{"seed", "alice", "bob"},
+			excluded: []string{"carol", "dave", "stranger"},
+		},
+		{
+			name:     "default two hops",
+			trusted:  []string{"seed", "alice", "bob", "carol"},
+			excluded: []string{"dave", "stranger"},
+		},
+		{
+			name:     "three hops",
+			maxHops:  3,
+			trusted:  []string{"seed", "alice", "bob", "carol", "dave"},
+			excluded: []string{"stranger"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lists := &fakeContactLists{lists: map[string][]string{
+				"seed":     {"alice", "bob"},
+				"alice":    {"carol", "seed"},
+				"carol":    {"dave"},
+				"stranger": {"seed"},
+			}}
+			w := newWebOfTrust(WebOfTrustConfig{Seeds: []string{"seed"}, MaxHops: tt.maxHops}, lists.get)
+			assert.NoError(t, w.rebuild())
+
+			for _, pubkey := range tt.trusted {
+				assert.True(t, w.trusted(pubkey), pubkey)
+			}
+			for _, pubkey := range tt.excluded {
+				assert.False(t, w.trusted(pubkey), pubkey)
+			}
+		})
+	}
+}
+
+func TestWebOfTrustOnlyFetchesWithinRange(t *testing.T) {
+	lists := &fakeContactLists{lists: map[string][]string{
+		"seed":  {"alice"},
+		"alice": {"bob"},
+		"bob":   {"carol"},
+	}}
+	w := newWebOfTrust(WebOfTrustConfig{Seeds: []string{"seed"}, MaxHops: 2}, lists.get)
+	assert.NoError(t, w.rebuild())
+
+	// bob is two hops away so who they follow doesn't matter
+	assert.ElementsMatch(t, []string{"seed", "alice"}, lists.fetched)
+
+	// Cached contact lists aren't fetched again
+	lists.fetched = nil
+	assert.NoError(t, w.rebuild())
+	assert.Empty(t, lists.fetched)
+}
+
+func TestWebOfTrustUpdate(t *testing.T) {
+	lists := &fakeContactLists{lists: map[string][]string{
+		"seed":  {"alice"},
+		"alice": {"bob"},
+		"carol": {"dave"},
+	}}
+	w := newWebOfTrust(WebOfTrustConfig{Seeds: []string{"seed"}, MaxHops: 2}, lists.get)
+	assert.NoError(t, w.rebuild())
+	assert.True(t, w.trusted("bob"))
+	assert.False(t, w.trusted("carol"))
+
+	// Following someone new brings them and who they follow into range
+	lists.lists["seed"] = []string{"alice", "carol"}
+	w.update("seed", contactList{follows: lists.lists["seed"], createdAt: 2})
+	assert.True(t, w.trusted("carol"))
+	assert.True(t, w.trusted("dave"))
+
+	// Unfollowing takes them out of range again
+	lists.lists["seed"] = []string{"alice"}
+	w.update("seed", contactList{follows: lists.lists["seed"], createdAt: 3})
+	assert.False(t, w.trusted("carol"))
+	assert.False(t, w.trusted("dave"))
+	assert.True(t, w.trusted("bob"))
+
+	// An older list saved late doesn't undo a newer one
+	w.update("seed", contactList{follows: []string{"alice", "carol"}, createdAt: 2})
+	assert.False(t, w.trusted("carol"))
+
+	// Contact lists of authors out of range are ignored until they're in
+	// range, when their latest saved list is fetched
+	lists.lists["carol"] = []string{"erin"}
+	w.update("carol", contactList{follows: lists.lists["carol"], createdAt: 2})
+	assert.False(t, w.trusted("erin"))
+
+	lists.lists["alice"] = []string{"bob", "carol"}
+	w.update("alice", contactList{follows: lists.lists["alice"], createdAt: 2})
+	assert.True(t, w.trusted("carol"))
+	assert.False(t, w.trusted("erin"))
+	assert.False(t, w.trusted("dave"))
+}
+
+func TestWebOfTrustRebuildError(t *testing.T) {
+	lists := &fakeContactLists{err: errors.New("db down")}
+	w := newWebOfTrust(WebOfTrustConfig{Seeds: []string{"seed"}}, lists.get)
+
+	assert.Error(t, w.rebuild())
+	assert.False(t, w.trusted("seed"))
+}
+
+func TestWebOfTrustRefresh(t *testing.T) {
+	lists := &fakeContactLists{err: errors.New("db down")}
+	w := newWebOfTrust(WebOfTrustConfig{Seeds: []string{"seed"}}, lists.get)
+
+	assert.Error(t, w.refresh())
+	assert.False(t, w.trusted("seed"))
+
+	// A later refresh recovers
+	lists.err = nil
+	lists.lists = map[string][]string{"seed": {"alice"}}
+	assert.NoError(t, w.refresh())
+	assert.True(t, w.trusted("alice"))
+
+	// and fetches cached contact lists again, picking up missed changes
+	lists.fetched = nil
+	lists.lists["seed"] = []string{"bob"}
+	assert.NoError(t, w.refresh())
+	assert.ElementsMatch(t, []string{"seed", "bob"}, lists.fetched)
+	assert.True(t, w.trusted("bob"))
+	assert.False(t, w.trusted("alice"))
+}
+
+func TestWebOfTrustEnqueue(t *testing.T) {
+	w := newWebOfTrust(WebOfTrustConfig{Seeds: []string{"seed"}}, (&fakeContactLists{}).get)
+
+	w.enqueue(&nostr.Event{PubKey: "seed", CreatedAt: 2, Tags: nostr.Tags{{"p", "alice"}}})
+	w.enqueue(&nostr.Event{PubKey: "seed", CreatedAt: 1, Tags: nostr.Tags{{"p", "bob"}}})
+
+	assert.Equal(t, contactListUpdate{pubkey: "seed", list: contactList{follows: []string{"alice"}, createdAt: 2}}, <-w.updates)
+	assert.Equal(t, contactListUpdate{pubkey: "seed", list: contactList{follows: []string{"bob"}, createdAt: 1}}, <-w.updates)
+
+	// A full queue drops lists rather than blocking the save
+	for i := 0; i < webOfTrustQueueSize+1; i++ {
+		w.enqueue(&nostr.Event{PubKey: "seed"})
+	}
+	assert.Len(t, w.updates, webOfTrustQueueSize)
+}
+
+func TestWebOfTrustNil(t *testing.T) {
+	var w *webOfTrust
+	assert.False(t, w.trusted("seed"))
+}
+
+func TestFollowedPubkeys(t *testing.T) {
+	tags := nostr.Tags{
+		{"p", "alice", "wss://relay.example"},
+		{"e", "12345"},
+		{"p", ""},
+		{"p"},
+		{"p", "bob"},
+	}
+	assert.Equal(t, []string{"alice", "bob"}, followedPubkeys(tags))
+}